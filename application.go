@@ -1,29 +1,192 @@
 package fh4server
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-	filterPause = flag.Bool("filter_pause", true, "when enabled, incoming data is ignored while the game is paused.")
+	filterPause     = flag.Bool("filter_pause", true, "when enabled, incoming data is ignored while the game is paused.")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 10*time.Second, "how long to wait for pending writes to finish when shutting down, before giving up on them.")
+)
+
+var (
+	packetsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fh4server_packets_dropped_total",
+		Help: "Number of packets read by Run that were not stored, by reason: read_error, parse_error or paused (see -filter_pause).",
+	}, []string{"reason"})
+	packetsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fh4server_packets_stored_total",
+		Help: "Number of packets Run passed on to the store.",
+	})
+	carsSeen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fh4server_cars",
+		Help: "Number of cars (source addresses) Run has received packets from.",
+	})
 )
 
 // Run is the main entry point for the service. `store` and `packetSource` are
 // interfaces that represent the service's source of input, and output
 // destination.
-func Run(whitelist Whitelist, packetSource PacketSource, store PacketStore) {
+//
+// Run returns once packetSource runs out of packets, or `ctx` is cancelled.
+// Either way, packetSource and store are closed if they implement io.Closer,
+// so that pending writes are drained. Closing the store is given
+// -shutdown_timeout to finish. The returned error describes what failed to
+// close; running out of packets and cancelling `ctx` are not errors.
+//
+// Packets that fail to parse are counted and dropped, so garbage sent to the
+// UDP port by other devices never reaches the store. When -track_sessions is
+// enabled, lap and session summaries are also written to the store.
+//
+// Several cars can send to the same server. Packets are tagged with the
+// address they were sent from (and the driver name from -driver_names), and
+// sessions and game clocks are tracked separately for each address.
+func Run(ctx context.Context, whitelist Whitelist, packetSource PacketSource, store PacketStore) error {
+	// Closing the source interrupts a ReadNextPacket that is waiting for the
+	// game.
+	var closeSourceOnce sync.Once
+	var sourceErr error
+	closeSource := func() {
+		closeSourceOnce.Do(func() {
+			if closer, ok := packetSource.(io.Closer); ok {
+				sourceErr = closer.Close()
+			}
+		})
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeSource()
+		case <-stopped:
+		}
+	}()
+
+	cars := make(map[string]*carState)
+	// frame is reused to decode every packet.
+	var frame TelemetryFrame
+	var droppedPackets, trailingBytesPackets int
 	for {
-		packetBuf := packetSource.ReadNextPacket()
-		timestamp := time.Now()
-		packet := ParseBuf(packetBuf, whitelist)
-
-		// TODO: once finishers are implemented, make is_race_on a bool.
-		// might not actually be super easy way to do this because tags are a
-		// map[string]string
-		if *filterPause && packet.Tags["is_race_on"] == "0" {
+		packetBuf, metadata, err := packetSource.ReadNextPacket()
+		if ctx.Err() != nil {
+			glog.Infof("shutting down")
+			break
+		}
+		if err == io.EOF {
+			glog.Infof("no more packets to read")
+			break
+		}
+		if err != nil {
+			packetsDropped.WithLabelValues("read_error").Inc()
+			glog.Errorf("failed to read packet: %v", err)
 			continue
 		}
-		go store.WritePacket(packet, timestamp)
+		received := metadata.ReceiveTime
+		if received.IsZero() {
+			received = time.Now()
+		}
+		// Every label is parsed so the session tracker has what it needs,
+		// the whitelist is applied afterwards.
+		packet, err := parseBufWithFrame(packetBuf, AllowAll(), &frame)
+		if trailingBytes, ok := err.(*TrailingBytesError); ok {
+			trailingBytesPackets++
+			glog.V(1).Infof("%v (%d packets with trailing bytes so far)", trailingBytes, trailingBytesPackets)
+		} else if err != nil {
+			droppedPackets++
+			packetsDropped.WithLabelValues("parse_error").Inc()
+			glog.Warningf("dropping packet: %v (%d dropped so far)", err, droppedPackets)
+			continue
+		}
+
+		driverNames.tag(&packet, metadata.Source)
+		car := cars[packet.Tags[sourceTag]]
+		if car == nil {
+			car = newCarState(store)
+			cars[packet.Tags[sourceTag]] = car
+			carsSeen.Set(float64(len(cars)))
+			if metadata.Source != nil {
+				glog.Infof("receiving packets from %v", metadata.Source)
+			}
+		}
+
+		packet.Timestamp = received
+		if car.clock != nil && packet.hasTimestampMs {
+			packet.Timestamp = car.clock.timestamp(packet.TimestampMs, packet.IsRaceOn, received)
+		}
+		if car.tracker != nil {
+			car.tracker.Track(packet)
+		}
+		if *filterPause && !packet.IsRaceOn {
+			packetsDropped.WithLabelValues("paused").Inc()
+			continue
+		}
+		store.WritePacket(packet.filter(whitelist))
+		packetsStored.Inc()
+	}
+
+	closeSource()
+	// The last session of each car has no packet to end it, so end them here
+	// to write their summaries before the store closes.
+	for _, car := range cars {
+		if car.tracker != nil {
+			car.tracker.End()
+		}
+	}
+	var failed []string
+	if sourceErr != nil {
+		failed = append(failed, fmt.Sprintf("failed to close packet source: %v", sourceErr))
+	}
+	if closer, ok := store.(io.Closer); ok {
+		if err := closeWithTimeout(closer, *shutdownTimeout); err != nil {
+			failed = append(failed, fmt.Sprintf("failed to close store: %v", err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// closeWithTimeout closes `closer`, giving up if it takes longer than
+// `timeout`. Close keeps running in the background after giving up.
+func closeWithTimeout(closer io.Closer, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- closer.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v, pending writes were lost", timeout)
+	}
+}
+
+// carState holds the state that Run keeps for each car sending packets.
+type carState struct {
+	tracker *SessionTracker
+	clock   *gameClock
+}
+
+func newCarState(store PacketStore) *carState {
+	car := &carState{}
+	if *trackSessions {
+		car.tracker = NewSessionTracker(store)
+	}
+	if *useGameClock {
+		car.clock = newGameClock(*gameClockMaxDrift)
 	}
+	return car
 }
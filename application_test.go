@@ -0,0 +1,150 @@
+package fh4server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingPacketSource is a PacketSource which returns `packet` once, then
+// blocks until it is closed, like the game's UDP connection. `blocked` is
+// closed once it blocks.
+type blockingPacketSource struct {
+	packet  []byte
+	blocked chan struct{}
+	closed  chan struct{}
+}
+
+func newBlockingPacketSource(packet []byte) *blockingPacketSource {
+	return &blockingPacketSource{packet: packet, blocked: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (source *blockingPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	if source.packet != nil {
+		next := source.packet
+		source.packet = nil
+		return bytes.NewBuffer(next), PacketMetadata{Length: len(next)}, nil
+	}
+	close(source.blocked)
+	<-source.closed
+	return nil, PacketMetadata{}, errors.New("use of closed network connection")
+}
+
+func (source *blockingPacketSource) Close() error {
+	close(source.closed)
+	return nil
+}
+
+// closingBatchStore is a BatchPacketStore which records whether it was
+// closed. Close blocks until `release` is closed.
+type closingBatchStore struct {
+	flakyBatchStore
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func newClosingBatchStore() *closingBatchStore {
+	return &closingBatchStore{release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (store *closingBatchStore) Close() error {
+	<-store.release
+	close(store.closed)
+	return nil
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	source := newBlockingPacketSource(packetBytes)
+	backend := newClosingBatchStore()
+	close(backend.release)
+	store, err := NewBatchingStore(backend, testBatchOptions())
+	r.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, AllowAll(), source, store)
+	}()
+	<-source.blocked
+	cancel()
+	select {
+	case err := <-done:
+		r.NoError(err)
+	case <-time.After(time.Second):
+		r.FailNow("timed out waiting for Run to return")
+	}
+
+	// The packet waiting for its batch, and the summaries of the session it
+	// started, were written before the store closed.
+	<-backend.closed
+	var written []string
+	for _, batch := range backend.batches {
+		for _, packet := range batch {
+			written = append(written, packet.Measurement)
+		}
+	}
+	r.Equal([]string{packetMeasurement, lapMeasurement, sessionMeasurement}, written)
+}
+
+func TestRunGivesUpOnSlowStore(t *testing.T) {
+	r := require.New(t)
+	defer func(timeout time.Duration) { *shutdownTimeout = timeout }(*shutdownTimeout)
+	*shutdownTimeout = 10 * time.Millisecond
+
+	backend := newClosingBatchStore()
+	defer close(backend.release)
+	store, err := NewBatchingStore(backend, testBatchOptions())
+	r.NoError(err)
+	err = Run(context.Background(), AllowAll(), &multiCarPacketSource{}, store)
+	r.Error(err)
+	r.Contains(err.Error(), "timed out")
+}
+
+func TestRunEndsSessionsWhenStopped(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	alice := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 21), Port: 50000}
+	defer func(names DriverNames) { driverNames = names }(driverNames)
+	driverNames = DriverNames{"192.168.1.20": "alice", "192.168.1.21": "bob"}
+
+	store := newRecordingStore()
+	err = Run(context.Background(), AllowAll(), &multiCarPacketSource{packets: []addressedPacket{
+		{packetBytes, alice},
+		{packetBytes, bob},
+	}}, store)
+	r.NoError(err)
+
+	sessions := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		sessions[store.next(r).Tags[sessionTag]] = true
+	}
+	// The sessions in progress when the source ends are written, with the lap
+	// in progress, before the store is closed.
+	laps := make(map[string]Packet)
+	for i := 0; i < 4; i++ {
+		summary := store.next(r)
+		r.True(sessions[summary.Tags[sessionTag]])
+		switch summary.Measurement {
+		case lapMeasurement:
+			r.Equal(true, summary.Fields["incomplete"])
+			laps[summary.Tags[sessionTag]] = summary
+		case sessionMeasurement:
+			r.Contains(laps, summary.Tags[sessionTag], "lap written after its session")
+			r.Equal(0, summary.Fields["laps"])
+		default:
+			r.FailNow("unexpected packet", summary.Measurement)
+		}
+	}
+	r.Len(laps, 2)
+}
@@ -0,0 +1,355 @@
+package fh4server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	batchSize       = flag.Int("batch_size", 500, "packets are written to the db in batches of up to this many packets.")
+	batchInterval   = flag.Duration("batch_interval", time.Second, "pending packets are written to the db at least this often.")
+	batchQueueSize  = flag.Int("batch_queue_size", 10000, "maximum number of packets waiting to be written to the db.")
+	batchDropPolicy = flag.String("batch_drop_policy", DropOldest, "what to do when the queue of packets waiting to be written is full. One of drop_oldest, drop_newest or block.")
+	batchMaxRetries = flag.Int("batch_max_retries", 5, "number of times a failed batch write is retried before the batch is dropped.")
+	batchBackoff    = flag.Duration("batch_backoff", 500*time.Millisecond, "how long to wait before retrying a failed batch write. Doubles after each retry.")
+)
+
+// Drop policies for a BatchingStore, used when its queue is full.
+const (
+	// DropOldest discards the oldest queued packet to make room.
+	DropOldest = "drop_oldest"
+	// DropNewest discards the packet being written.
+	DropNewest = "drop_newest"
+	// Block waits until there is room in the queue.
+	Block = "block"
+)
+
+// maxBatchBackoff limits how long a BatchingStore waits between retries.
+const maxBatchBackoff = 30 * time.Second
+
+// BatchOptions configures a BatchingStore.
+type BatchOptions struct {
+	// Size is the maximum number of packets in a batch.
+	Size int
+	// Interval is the longest a packet waits before its batch is written.
+	Interval time.Duration
+	// QueueSize is the maximum number of packets waiting to be batched.
+	QueueSize int
+	// DropPolicy is one of DropOldest, DropNewest or Block.
+	DropPolicy string
+	// MaxRetries is the number of times a failed write is retried.
+	MaxRetries int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// Spool, if set, holds batches that could not be written so they can be
+	// written later, instead of dropping them.
+	Spool *DiskSpool
+}
+
+// BatchOptionsFromFlags returns the BatchOptions given by the -batch_* flags.
+func BatchOptionsFromFlags() BatchOptions {
+	return BatchOptions{
+		Size:       *batchSize,
+		Interval:   *batchInterval,
+		QueueSize:  *batchQueueSize,
+		DropPolicy: *batchDropPolicy,
+		MaxRetries: *batchMaxRetries,
+		Backoff:    *batchBackoff,
+	}
+}
+
+// BatchStats holds counters describing the packets handled by a
+// BatchingStore.
+type BatchStats struct {
+	// Written is the number of packets that were written successfully.
+	Written uint64
+	// Dropped is the number of packets that were discarded, either because
+	// the queue was full or because their batch could not be written.
+	Dropped uint64
+	// Retried is the number of packets in batches that were retried.
+	Retried uint64
+	// Spooled is the number of packets that were written to the spool.
+	Spooled uint64
+	// Queued is the number of packets currently waiting to be written.
+	Queued uint64
+}
+
+// BatchingStore implements PacketStore by queueing packets and writing them to
+// a BatchPacketStore in batches from a single goroutine. Failed batches are
+// retried with exponential backoff.
+//
+// When a spool is configured, batches that still can't be written are spooled
+// to disk. While the spool is not empty every new batch is also spooled, so
+// that packets are written in order, and the spool is replayed each interval.
+// Once Close is called failed batches are no longer retried, so that closing
+// doesn't wait out the backoff.
+type BatchingStore struct {
+	store   BatchPacketStore
+	options BatchOptions
+	queue   chan Packet
+	done    chan struct{}
+	// closed is closed when Close is called, to stop retrying.
+	closed  chan struct{}
+	closing sync.Once
+
+	written uint64
+	dropped uint64
+	retried uint64
+	spooled uint64
+}
+
+// maxReplayBatches limits how many spooled batches are replayed at once, so
+// that the queue keeps being drained while the spool is replayed.
+const maxReplayBatches = 10
+
+// NewBatchingStore starts a BatchingStore which writes to `store`.
+func NewBatchingStore(store BatchPacketStore, options BatchOptions) (*BatchingStore, error) {
+	switch options.DropPolicy {
+	case DropOldest, DropNewest, Block:
+	default:
+		return nil, fmt.Errorf("unknown drop policy %q", options.DropPolicy)
+	}
+	if options.Size <= 0 || options.QueueSize <= 0 || options.Interval <= 0 {
+		return nil, fmt.Errorf("batch size, queue size and interval must be positive")
+	}
+	batchingStore := &BatchingStore{
+		store:   store,
+		options: options,
+		queue:   make(chan Packet, options.QueueSize),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go batchingStore.run()
+	return batchingStore, nil
+}
+
+// WritePacket queues the packet to be written. If the queue is full, the
+// packet is handled according to the drop policy.
+func (batchingStore *BatchingStore) WritePacket(packet Packet) {
+	if batchingStore.options.DropPolicy == Block {
+		batchingStore.queue <- packet
+		return
+	}
+	for {
+		select {
+		case batchingStore.queue <- packet:
+			return
+		default:
+		}
+		if batchingStore.options.DropPolicy == DropNewest {
+			batchingStore.drop(1)
+			return
+		}
+		// Make room by discarding the oldest packet, then try again.
+		select {
+		case <-batchingStore.queue:
+			batchingStore.drop(1)
+		default:
+		}
+	}
+}
+
+// Stats returns the current counters of the store.
+func (batchingStore *BatchingStore) Stats() BatchStats {
+	return BatchStats{
+		Written: atomic.LoadUint64(&batchingStore.written),
+		Dropped: atomic.LoadUint64(&batchingStore.dropped),
+		Retried: atomic.LoadUint64(&batchingStore.retried),
+		Spooled: atomic.LoadUint64(&batchingStore.spooled),
+		Queued:  uint64(len(batchingStore.queue)),
+	}
+}
+
+// Healthy reports the health of the wrapped store, if it is a HealthChecker.
+func (batchingStore *BatchingStore) Healthy() error {
+	if checker, ok := batchingStore.store.(HealthChecker); ok {
+		return checker.Healthy()
+	}
+	return nil
+}
+
+var (
+	batchPacketsDesc = prometheus.NewDesc("fh4server_batch_packets_total",
+		"Number of packets handled by the batching store, by result: written, dropped, retried or spooled.",
+		[]string{"result"}, nil)
+	batchQueuedDesc = prometheus.NewDesc("fh4server_batch_queued_packets",
+		"Number of packets waiting to be batched and written.", nil, nil)
+)
+
+// Describe implements prometheus.Collector, so that Stats can be exported
+// once the store is registered.
+func (batchingStore *BatchingStore) Describe(descs chan<- *prometheus.Desc) {
+	descs <- batchPacketsDesc
+	descs <- batchQueuedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (batchingStore *BatchingStore) Collect(metrics chan<- prometheus.Metric) {
+	stats := batchingStore.Stats()
+	for result, count := range map[string]uint64{"written": stats.Written, "dropped": stats.Dropped, "retried": stats.Retried, "spooled": stats.Spooled} {
+		metrics <- prometheus.MustNewConstMetric(batchPacketsDesc, prometheus.CounterValue, float64(count), result)
+	}
+	metrics <- prometheus.MustNewConstMetric(batchQueuedDesc, prometheus.GaugeValue, float64(stats.Queued))
+}
+
+// Close writes any queued packets and stops the store, then closes the spool,
+// if there is one, and the wrapped store if it is an io.Closer. Batches which
+// fail are spooled or dropped without being retried. WritePacket must not be
+// called after Close.
+func (batchingStore *BatchingStore) Close() error {
+	var err error
+	batchingStore.closing.Do(func() {
+		close(batchingStore.closed)
+		close(batchingStore.queue)
+		<-batchingStore.done
+		if spool := batchingStore.options.Spool; spool != nil {
+			if spoolErr := spool.Close(); spoolErr != nil {
+				err = fmt.Errorf("failed to close spool: %v", spoolErr)
+			}
+		}
+		if closer, ok := batchingStore.store.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	<-batchingStore.done
+	return err
+}
+
+func (batchingStore *BatchingStore) drop(count int) {
+	dropped := atomic.AddUint64(&batchingStore.dropped, uint64(count))
+	// Packets are dropped one at a time while the queue is full, so only
+	// every 100th drop is logged.
+	if count > 1 || dropped%100 == 1 {
+		glog.Warningf("dropped %d packets (%d dropped so far)", count, dropped)
+	}
+}
+
+func (batchingStore *BatchingStore) run() {
+	defer close(batchingStore.done)
+	ticker := time.NewTicker(batchingStore.options.Interval)
+	defer ticker.Stop()
+
+	batch := make([]Packet, 0, batchingStore.options.Size)
+	for {
+		select {
+		case packet, ok := <-batchingStore.queue:
+			if !ok {
+				batchingStore.flush(batch)
+				return
+			}
+			batch = append(batch, packet)
+			if len(batch) < batchingStore.options.Size {
+				continue
+			}
+		case <-ticker.C:
+			batchingStore.replaySpool()
+		}
+		batchingStore.flush(batch)
+		batch = make([]Packet, 0, batchingStore.options.Size)
+	}
+}
+
+// flush writes the batch, retrying with exponential backoff on failure until
+// the store is closed.
+func (batchingStore *BatchingStore) flush(batch []Packet) {
+	if len(batch) == 0 {
+		return
+	}
+	spool := batchingStore.options.Spool
+	if spool != nil && !spool.Empty() {
+		batchingStore.spool(batch)
+		return
+	}
+	backoff := batchingStore.options.Backoff
+	for attempt := 0; ; attempt++ {
+		err := batchingStore.store.WritePackets(batch)
+		if err == nil {
+			atomic.AddUint64(&batchingStore.written, uint64(len(batch)))
+			return
+		}
+		if attempt >= batchingStore.options.MaxRetries || batchingStore.isClosed() {
+			glog.Errorf("giving up writing batch of %d packets after %d attempts: %v", len(batch), attempt+1, err)
+			if spool != nil {
+				batchingStore.spool(batch)
+			} else {
+				batchingStore.drop(len(batch))
+			}
+			return
+		}
+		glog.Warningf("failed to write batch of %d packets, retrying in %v: %v", len(batch), backoff, err)
+		atomic.AddUint64(&batchingStore.retried, uint64(len(batch)))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-batchingStore.closed:
+			timer.Stop()
+		}
+		backoff *= 2
+		if backoff > maxBatchBackoff {
+			backoff = maxBatchBackoff
+		}
+	}
+}
+
+// isClosed returns whether Close has been called.
+func (batchingStore *BatchingStore) isClosed() bool {
+	select {
+	case <-batchingStore.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (batchingStore *BatchingStore) spool(batch []Packet) {
+	if err := batchingStore.options.Spool.Append(batch); err != nil {
+		glog.Errorf("failed to spool batch: %v", err)
+		batchingStore.drop(len(batch))
+		return
+	}
+	atomic.AddUint64(&batchingStore.spooled, uint64(len(batch)))
+}
+
+// replaySpool writes batches from the spool, oldest first, until the spool is
+// empty or a write fails.
+func (batchingStore *BatchingStore) replaySpool() {
+	spool := batchingStore.options.Spool
+	if spool == nil {
+		return
+	}
+	for i := 0; i < maxReplayBatches; i++ {
+		batch, err := spool.Peek()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			glog.Errorf("failed to read spool, discarding batch: %v", err)
+			if err := spool.Pop(); err != nil {
+				glog.Errorf("failed to remove batch from spool: %v", err)
+				return
+			}
+			continue
+		}
+		if err := batchingStore.store.WritePackets(batch); err != nil {
+			glog.V(1).Infof("store still unavailable, not replaying spool: %v", err)
+			return
+		}
+		atomic.AddUint64(&batchingStore.written, uint64(len(batch)))
+		if err := spool.Pop(); err != nil {
+			glog.Errorf("failed to remove batch from spool: %v", err)
+			return
+		}
+		if spool.Empty() {
+			glog.Infof("finished replaying spool")
+		}
+	}
+}
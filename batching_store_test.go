@@ -0,0 +1,126 @@
+package fh4server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBatchStore is a BatchPacketStore which fails the first `failures`
+// writes.
+type flakyBatchStore struct {
+	mu       sync.Mutex
+	failures int
+	batches  [][]Packet
+}
+
+func (store *flakyBatchStore) WritePackets(packets []Packet) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.failures > 0 {
+		store.failures--
+		return errors.New("unavailable")
+	}
+	store.batches = append(store.batches, packets)
+	return nil
+}
+
+func testBatchOptions() BatchOptions {
+	return BatchOptions{
+		Size:       2,
+		Interval:   time.Hour,
+		QueueSize:  10,
+		DropPolicy: DropOldest,
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+	}
+}
+
+func TestBatchingStoreRetries(t *testing.T) {
+	r := require.New(t)
+	backend := &flakyBatchStore{failures: 2}
+	store, err := NewBatchingStore(backend, testBatchOptions())
+	r.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		store.WritePacket(Packet{Measurement: "test"})
+	}
+	// Close stops retrying, so wait for the full batches to be written.
+	waitForBatchStats(t, store, func(stats BatchStats) bool { return stats.Written == 4 })
+	store.Close()
+
+	r.Len(backend.batches, 3)
+	r.Len(backend.batches[0], 2)
+	r.Len(backend.batches[2], 1)
+	r.Equal(BatchStats{Written: 5, Retried: 4}, store.Stats())
+}
+
+func TestBatchingStoreDropsAfterRetries(t *testing.T) {
+	r := require.New(t)
+	backend := &flakyBatchStore{failures: 3}
+	options := testBatchOptions()
+	options.Size = 1
+	store, err := NewBatchingStore(backend, options)
+	r.NoError(err)
+
+	store.WritePacket(Packet{})
+	waitForBatchStats(t, store, func(stats BatchStats) bool { return stats.Dropped == 1 })
+	store.Close()
+
+	r.Empty(backend.batches)
+	r.Equal(BatchStats{Dropped: 1, Retried: 2}, store.Stats())
+}
+
+func TestBatchingStoreStopsRetryingOnClose(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	spool, err := OpenDiskSpool(dir, 1<<20, 1<<20)
+	r.NoError(err)
+
+	backend := &flakyBatchStore{failures: 100}
+	options := testBatchOptions()
+	options.Size = 1
+	options.Backoff = time.Hour
+	options.Spool = spool
+	store, err := NewBatchingStore(backend, options)
+	r.NoError(err)
+
+	store.WritePacket(spoolBatch(1)[0])
+	waitForBatchStats(t, store, func(stats BatchStats) bool { return stats.Retried == 1 })
+	start := time.Now()
+	r.NoError(store.Close())
+	r.Less(int64(time.Since(start)), int64(time.Second))
+
+	r.Empty(backend.batches)
+	r.Equal(BatchStats{Retried: 1, Spooled: 1}, store.Stats())
+	// The batch is still on disk once the spool has been closed.
+	spool, err = OpenDiskSpool(dir, 1<<20, 1<<20)
+	r.NoError(err)
+	defer spool.Close()
+	batch, err := spool.Peek()
+	r.NoError(err)
+	r.Equal(spoolBatch(1), batch)
+}
+
+// waitForBatchStats waits up to a second for the store's stats to satisfy
+// done.
+func waitForBatchStats(t *testing.T, store *BatchingStore, done func(BatchStats) bool) {
+	for deadline := time.Now().Add(time.Second); !done(store.Stats()); {
+		require.True(t, time.Now().Before(deadline), "timed out waiting for %+v", store.Stats())
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchingStoreRejectsUnknownDropPolicy(t *testing.T) {
+	options := testBatchOptions()
+	options.DropPolicy = "drop_everything"
+	_, err := NewBatchingStore(&flakyBatchStore{}, options)
+	require.Error(t, err)
+}
@@ -0,0 +1,260 @@
+package fh4server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	recordCapture = flag.String("record_capture", "", "when set, every packet received is also recorded to this capture file.")
+	replayCapture = flag.String("replay_capture", "", "when set, packets are replayed from this capture file instead of being received from the game.")
+	replaySpeed   = flag.Float64("replay_speed", 1, "speed at which -replay_capture is replayed, e.g. 2 for twice the original speed. 0 replays as fast as possible.")
+)
+
+// captureMagic starts every capture file, followed by a byte holding the
+// version of the capture format.
+const captureMagic = "FH4CAP\x00"
+
+// Versions of the capture format. captureVersion is written, both are read.
+const (
+	captureVersion1 = 1
+	captureVersion  = 2
+)
+
+// A capture file is captureMagic and the version followed by one record per
+// packet:
+//
+//	int64  receive time, in nanoseconds since the unix epoch
+//	uint16 length of the packet
+//	uint8  length of the sender's IP address: 0, 4 or 16 (version 2 only)
+//	[]byte the sender's IP address (version 2 only)
+//	uint16 the sender's port, if the address is not empty (version 2 only)
+//	[]byte the packet
+//
+// All values are little endian.
+const captureRecordHeaderSize = 8 + 2
+
+// RecordingPacketSource implements PacketSource by reading packets from
+// another PacketSource, and recording them to a capture file along with the
+// time they were received.
+type RecordingPacketSource struct {
+	source PacketSource
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewRecordingPacketSourceFromFlags wraps `source` in a RecordingPacketSource
+// if -record_capture is set. Otherwise `source` is returned as is.
+func NewRecordingPacketSourceFromFlags(source PacketSource) (PacketSource, error) {
+	if *recordCapture == "" {
+		return source, nil
+	}
+	return NewRecordingPacketSource(source, *recordCapture)
+}
+
+// NewRecordingPacketSource creates the capture file at `path`, replacing any
+// existing file.
+func NewRecordingPacketSource(source PacketSource, path string) (*RecordingPacketSource, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %v", err)
+	}
+	writer := bufio.NewWriter(file)
+	if _, err := writer.WriteString(captureMagic + string(rune(captureVersion))); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write capture file: %v", err)
+	}
+	glog.Infof("recording packets to %s", path)
+	return &RecordingPacketSource{source: source, file: file, writer: writer}, nil
+}
+
+// ReadNextPacket reads the next packet from the wrapped source and records it.
+// Failing to record a packet is logged, but does not stop the packet from
+// being returned.
+func (recorder *RecordingPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	buf, metadata, err := recorder.source.ReadNextPacket()
+	if err != nil {
+		return buf, metadata, err
+	}
+	if metadata.ReceiveTime.IsZero() {
+		metadata.ReceiveTime = time.Now()
+	}
+	if err := recorder.record(buf.Bytes(), metadata); err != nil {
+		glog.Errorf("failed to record packet: %v", err)
+	}
+	return buf, metadata, nil
+}
+
+func (recorder *RecordingPacketSource) record(packet []byte, metadata PacketMetadata) error {
+	if len(packet) > 0xffff {
+		return fmt.Errorf("packet too large to record (%d bytes)", len(packet))
+	}
+	header := make([]byte, captureRecordHeaderSize, captureRecordHeaderSize+1+net.IPv6len+2)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(metadata.ReceiveTime.UnixNano()))
+	binary.LittleEndian.PutUint16(header[8:10], uint16(len(packet)))
+	var ip net.IP
+	if metadata.Source != nil {
+		if ip = metadata.Source.IP.To4(); ip == nil {
+			ip = metadata.Source.IP.To16()
+		}
+	}
+	header = append(header, byte(len(ip)))
+	if len(ip) > 0 {
+		header = append(header, ip...)
+		header = append(header, byte(metadata.Source.Port), byte(metadata.Source.Port>>8))
+	}
+	if _, err := recorder.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := recorder.writer.Write(packet); err != nil {
+		return err
+	}
+	// Flushed after every packet so that a crash loses as little as possible.
+	return recorder.writer.Flush()
+}
+
+// Close should be called when the RecordingPacketSource is no longer needed.
+// This closes the capture file, and the wrapped source if it is an io.Closer.
+func (recorder *RecordingPacketSource) Close() error {
+	var sourceErr error
+	if closer, ok := recorder.source.(io.Closer); ok {
+		sourceErr = closer.Close()
+	}
+	if err := recorder.writer.Flush(); err != nil {
+		recorder.file.Close()
+		return fmt.Errorf("failed to flush capture file: %v", err)
+	}
+	if err := recorder.file.Close(); err != nil {
+		return err
+	}
+	return sourceErr
+}
+
+// ReplayPacketSource implements PacketSource by replaying the packets from a
+// capture file, with the same spacing as when they were recorded (adjusted by
+// the replay speed). ReadNextPacket returns io.EOF at the end of the capture.
+type ReplayPacketSource struct {
+	file    *os.File
+	reader  *bufio.Reader
+	speed   float64
+	version byte
+	// closed is closed by Close, to interrupt waiting for the next packet.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// firstCaptured and firstReplayed are the times of the first packet in
+	// the capture, and when it was replayed.
+	firstCaptured time.Time
+	firstReplayed time.Time
+}
+
+// NewReplayPacketSourceFromFlags opens the capture given by -replay_capture,
+// or returns nil if the flag is not set.
+func NewReplayPacketSourceFromFlags() (*ReplayPacketSource, error) {
+	if *replayCapture == "" {
+		return nil, nil
+	}
+	return NewReplayPacketSource(*replayCapture, *replaySpeed)
+}
+
+// NewReplayPacketSource opens the capture file at `path`. `speed` is a
+// multiplier for the replay speed, or 0 to replay as fast as possible.
+func NewReplayPacketSource(path string, speed float64) (*ReplayPacketSource, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("invalid replay speed %v", speed)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %v", err)
+	}
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic[:len(captureMagic)]) != captureMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a capture file", path)
+	}
+	version := magic[len(captureMagic)]
+	if version != captureVersion1 && version != captureVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s has unsupported capture version %d", path, version)
+	}
+	glog.Infof("replaying packets from %s", path)
+	return &ReplayPacketSource{file: file, reader: reader, speed: speed, version: version, closed: make(chan struct{})}, nil
+}
+
+// ReadNextPacket waits until the next packet is due, and returns it.
+func (replay *ReplayPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	var header [captureRecordHeaderSize]byte
+	if _, err := io.ReadFull(replay.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			glog.Warningf("capture file ends with a truncated record")
+			err = io.EOF
+		}
+		return nil, PacketMetadata{}, err
+	}
+	captured := time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8])))
+	metadata := PacketMetadata{ReceiveTime: captured, Length: int(binary.LittleEndian.Uint16(header[8:10]))}
+	if replay.version >= captureVersion {
+		source, err := replay.readSource()
+		if err != nil {
+			glog.Warningf("capture file ends with a truncated record")
+			return nil, PacketMetadata{}, io.EOF
+		}
+		metadata.Source = source
+	}
+	packet := make([]byte, metadata.Length)
+	if _, err := io.ReadFull(replay.reader, packet); err != nil {
+		glog.Warningf("capture file ends with a truncated record")
+		return nil, PacketMetadata{}, io.EOF
+	}
+
+	if replay.firstCaptured.IsZero() {
+		replay.firstCaptured = captured
+		replay.firstReplayed = time.Now()
+	} else if replay.speed > 0 {
+		offset := time.Duration(float64(captured.Sub(replay.firstCaptured)) / replay.speed)
+		select {
+		case <-time.After(time.Until(replay.firstReplayed.Add(offset))):
+		case <-replay.closed:
+			return nil, PacketMetadata{}, io.EOF
+		}
+	}
+	return bytes.NewBuffer(packet), metadata, nil
+}
+
+// readSource reads the sender's address from a record, which is nil if the
+// sender was not known.
+func (replay *ReplayPacketSource) readSource() (*net.UDPAddr, error) {
+	length, err := replay.reader.ReadByte()
+	if err != nil || length == 0 {
+		return nil, err
+	}
+	if length != net.IPv4len && length != net.IPv6len {
+		return nil, fmt.Errorf("invalid address length %d", length)
+	}
+	address := make([]byte, int(length)+2)
+	if _, err := io.ReadFull(replay.reader, address); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(address[:length]),
+		Port: int(binary.LittleEndian.Uint16(address[length:])),
+	}, nil
+}
+
+// Close should be called when the ReplayPacketSource is no longer needed. A
+// ReadNextPacket waiting for the next packet returns io.EOF.
+func (replay *ReplayPacketSource) Close() error {
+	replay.closeOnce.Do(func() { close(replay.closed) })
+	return replay.file.Close()
+}
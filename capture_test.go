@@ -0,0 +1,89 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// slicePacketSource is a PacketSource which returns each of its packets once,
+// sent from `source`.
+type slicePacketSource struct {
+	packets [][]byte
+	source  *net.UDPAddr
+}
+
+func (source *slicePacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	if len(source.packets) == 0 {
+		return nil, PacketMetadata{}, io.EOF
+	}
+	packet := source.packets[0]
+	source.packets = source.packets[1:]
+	return bytes.NewBuffer(packet), PacketMetadata{Source: source.source, Length: len(packet)}, nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "capture")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.fh4cap")
+
+	packets := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xff}, 324)}
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}
+	recorder, err := NewRecordingPacketSource(&slicePacketSource{packets: packets, source: source}, path)
+	r.NoError(err)
+	var recorded []PacketMetadata
+	for range packets {
+		_, metadata, err := recorder.ReadNextPacket()
+		r.NoError(err)
+		recorded = append(recorded, metadata)
+	}
+	_, _, err = recorder.ReadNextPacket()
+	r.Equal(io.EOF, err)
+	recorder.Close()
+
+	replay, err := NewReplayPacketSource(path, 0)
+	r.NoError(err)
+	defer replay.Close()
+	for i, expected := range packets {
+		buf, metadata, err := replay.ReadNextPacket()
+		r.NoError(err)
+		r.Equal(expected, buf.Bytes())
+		r.True(recorded[i].ReceiveTime.Equal(metadata.ReceiveTime))
+		r.Equal(source.String(), metadata.Source.String())
+		r.Equal(len(expected), metadata.Length)
+	}
+	_, _, err = replay.ReadNextPacket()
+	r.Equal(io.EOF, err)
+}
+
+func TestReplayVersion1Capture(t *testing.T) {
+	r := require.New(t)
+	capture := []byte(captureMagic + "\x01")
+	record := make([]byte, captureRecordHeaderSize)
+	binary.LittleEndian.PutUint64(record[0:8], uint64(time.Unix(1559390400, 0).UnixNano()))
+	binary.LittleEndian.PutUint16(record[8:10], 5)
+	capture = append(append(capture, record...), "first"...)
+	path := writeTestCapture(r, capture)
+	defer os.Remove(path)
+
+	replay, err := NewReplayPacketSource(path, 0)
+	r.NoError(err)
+	defer replay.Close()
+	buf, metadata, err := replay.ReadNextPacket()
+	r.NoError(err)
+	r.Equal("first", buf.String())
+	r.Nil(metadata.Source)
+	r.Equal(time.Unix(1559390400, 0), metadata.ReceiveTime)
+	_, _, err = replay.ReadNextPacket()
+	r.Equal(io.EOF, err)
+}
@@ -0,0 +1,39 @@
+// fh4parquet converts capture files recorded with -record_capture to Parquet
+// files, the same as fh4server writes with -parquet_dir:
+//
+//	go run ./cmd/fh4parquet -parquet_dir=./parquet race.fh4cap [more.fh4cap ...]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/narrative/fh4server"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -parquet_dir=<dir> <capture>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	options := fh4server.ParquetOptionsFromFlags()
+	if options.Dir == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := fh4server.LoadPacketDefinition(); err != nil {
+		glog.Exitf("failed to load packet definition: %v", err)
+	}
+	for _, capture := range flag.Args() {
+		glog.Infof("converting %s", capture)
+		if err := fh4server.ConvertCapture(context.Background(), capture, options); err != nil {
+			glog.Exitf("failed to convert %s: %v", capture, err)
+		}
+	}
+	glog.Flush()
+}
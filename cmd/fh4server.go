@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"time"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/narrative/fh4server"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -15,32 +20,142 @@ var (
 )
 
 func main() {
+	if err := run(); err != nil {
+		glog.Exit(err)
+	}
+	glog.Flush()
+}
+
+// run sets up the packet source and stores from the flags, and runs until the
+// packet source runs out of packets or the process is told to stop. Errors are
+// returned rather than exiting, so that whatever has been set up is closed.
+func run() error {
 	flag.Parse()
 	glog.Infof("Running with the following options set: ")
 	flag.VisitAll(func(f *flag.Flag) {
 		glog.Infof("%s = %s", f.Name, f.Value)
 	})
 
+	if err := fh4server.LoadPacketDefinition(); err != nil {
+		return fmt.Errorf("failed to load packet definition: %v", err)
+	}
+
 	var packetSource fh4server.PacketSource
-	if *simulatePacketSource {
-		packetSource = fh4server.NewSimulatedPacketSource(2 * time.Second)
+	replay, err := fh4server.NewReplayPacketSourceFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to open capture: %v", err)
+	}
+	pcap, err := fh4server.NewPcapPacketSourceFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to open pcap: %v", err)
+	}
+	// Run closes the packet source and the stores once it stops.
+	var fh4Game *fh4server.FH4Game
+	if replay != nil {
+		packetSource = replay
+	} else if pcap != nil {
+		packetSource = pcap
+	} else if *simulatePacketSource {
+		packetSource, err = fh4server.NewSimulatedPacketSourceFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to set up simulated packet source: %v", err)
+		}
 	} else {
-		fh4Game := fh4server.NewFH4Game()
-		defer fh4Game.Close()
+		fh4Game = fh4server.NewFH4Game()
 		packetSource = fh4Game
 	}
 
+	packetSource, err = fh4server.NewRecordingPacketSourceFromFlags(packetSource)
+	if err != nil {
+		return fmt.Errorf("failed to start recording: %v", err)
+	}
+
 	var store fh4server.PacketStore
+	var storeName string
+	var blockStore bool
 	if *simulateDataStore {
 		store = fh4server.NewSimulatedDataStore(50)
+		storeName = "simulated"
 	} else {
-		influx, err := fh4server.NewInfluxStore()
+		var db fh4server.BatchPacketStore
+		storeName, db, err = fh4server.NewDBStoreFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to connect to db: %v", err)
+		}
+		batchOptions := fh4server.BatchOptionsFromFlags()
+		batchOptions.Spool, err = fh4server.OpenDiskSpoolFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to open spool: %v", err)
+		}
+		batchingStore, err := fh4server.NewBatchingStore(db, batchOptions)
 		if err != nil {
-			glog.Fatalf("failed to connect to db: %v", err)
+			return fmt.Errorf("invalid batch options: %v", err)
+		}
+		prometheus.MustRegister(batchingStore)
+		store = batchingStore
+		// With the block drop policy, the db holds up the game rather than
+		// having packets dropped in front of it.
+		blockStore = batchOptions.DropPolicy == fh4server.Block
+	}
+
+	// Packets are also pushed to browsers connected to the live stream.
+	stream := fh4server.NewLiveStreamFromFlags()
+	defer stream.Close()
+	httpServer, err := fh4server.NewHTTPServerFromFlags(stream)
+	if err != nil {
+		return fmt.Errorf("failed to start http server: %v", err)
+	}
+
+	composite := fh4server.NewCompositeStore()
+	sinkOptions := fh4server.SinkOptionsFromFlags(storeName)
+	sinkOptions.Block = blockStore
+	composite.Add(storeName, store, sinkOptions)
+	parquetStore, err := fh4server.NewParquetStoreFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to set up parquet files: %v", err)
+	}
+	if parquetStore != nil {
+		composite.Add("parquet", parquetStore, fh4server.SinkOptionsFromFlags("parquet"))
+	}
+	csvStore, err := fh4server.NewCSVStoreFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to set up csv files: %v", err)
+	}
+	if csvStore != nil {
+		composite.Add("csv", csvStore, fh4server.SinkOptionsFromFlags("csv"))
+	}
+	ndjsonStore, err := fh4server.NewNDJSONStoreFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to set up ndjson files: %v", err)
+	}
+	if ndjsonStore != nil {
+		composite.Add("ndjson", ndjsonStore, fh4server.SinkOptionsFromFlags("ndjson"))
+	}
+	prometheus.MustRegister(composite)
+	if httpServer != nil {
+		if fh4Game != nil {
+			httpServer.AddLivenessCheck("udp", fh4Game)
 		}
-		defer influx.Close()
-		store = influx
+		httpServer.AddReadinessCheck("store", composite)
+		defer httpServer.Close()
+		composite.Add("stream", stream, fh4server.SinkOptionsFromFlags("stream"))
 	}
 
-	fh4server.Run(fh4server.AllowAll(), packetSource, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.Infof("received %v, shutting down", sig)
+		cancel()
+		// A second signal exits without waiting for the shutdown.
+		sig = <-signals
+		glog.Exitf("received %v again, exiting", sig)
+	}()
+
+	if err := fh4server.Run(ctx, fh4server.AllowAll(), packetSource, composite); err != nil {
+		return fmt.Errorf("failed to shut down cleanly: %v", err)
+	}
+	return nil
 }
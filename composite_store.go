@@ -0,0 +1,295 @@
+package fh4server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var storeOptions = make(StoreOptionsFlag)
+
+func init() {
+	flag.Var(storeOptions, "store_options", "options for one of the stores packets are written to, as name:option=value&option=value, e.g. influx:every=6&fields=speed,gear,car_id. "+
+		"Options are fields (comma separated whitelist of fields and tags), every (write one in every n packets), interval (write at most one packet per car per interval, e.g. 100ms) and queue_size. "+
+		"Can be repeated, once per store.")
+}
+
+// defaultSinkQueueSize is the number of packets queued for a store of a
+// CompositeStore when no queue size is given.
+const defaultSinkQueueSize = 1000
+
+// SinkOptions configures one of the stores of a CompositeStore.
+type SinkOptions struct {
+	// Whitelist limits the fields and tags of the packets written to the
+	// store. All are written if it is nil. Lap and session summaries are
+	// written whole.
+	Whitelist Whitelist
+	// Every writes one in every `Every` packets from the game. 0 and 1 write
+	// every packet.
+	Every int
+	// Interval writes at most one packet from each car per interval, based
+	// on the packet timestamps.
+	Interval time.Duration
+	// QueueSize is the number of packets waiting to be written before
+	// packets are dropped.
+	QueueSize int
+	// Block makes WritePacket wait for room in the queue instead of dropping
+	// packets, e.g. for a BatchingStore with the Block drop policy, which
+	// holds up every store.
+	Block bool
+}
+
+// StoreOptionsFlag holds the SinkOptions of each store, keyed by the store's
+// name. It implements flag.Value.
+type StoreOptionsFlag map[string]SinkOptions
+
+// String returns the names of the stores with options.
+func (options StoreOptionsFlag) String() string {
+	var names []string
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Set parses the options for one store.
+func (options StoreOptionsFlag) Set(spec string) error {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name:options, got %q", spec)
+	}
+	values, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid options for %s: %v", parts[0], err)
+	}
+	var sinkOptions SinkOptions
+	for option := range values {
+		value := values.Get(option)
+		switch option {
+		case "fields":
+			sinkOptions.Whitelist = AllowList(strings.Split(value, ","))
+		case "every":
+			sinkOptions.Every, err = strconv.Atoi(value)
+		case "interval":
+			sinkOptions.Interval, err = time.ParseDuration(value)
+		case "queue_size":
+			sinkOptions.QueueSize, err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("unknown option %q for %s", option, parts[0])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s for %s: %v", option, parts[0], err)
+		}
+	}
+	options[parts[0]] = sinkOptions
+	return nil
+}
+
+// SinkOptionsFromFlags returns the options given by -store_options for the
+// named store.
+func SinkOptionsFromFlags(name string) SinkOptions {
+	return storeOptions[name]
+}
+
+// SinkStats holds counters describing the packets handled by one of the
+// stores of a CompositeStore.
+type SinkStats struct {
+	// Written is the number of packets passed on to the store.
+	Written uint64
+	// Dropped is the number of packets discarded because the store fell
+	// behind.
+	Dropped uint64
+	// Queued is the number of packets waiting to be passed on.
+	Queued uint64
+}
+
+// CompositeStore implements PacketStore by writing every packet to several
+// stores, e.g. the db and the live stream. Each store has its own whitelist
+// and sampling, see SinkOptions.
+//
+// Each store is written to from its own goroutine through a bounded queue, so
+// a store that fails or is slow can't stall the others. Packets are dropped
+// for a store whose queue is full, unless the store's SinkOptions.Block is
+// set.
+type CompositeStore struct {
+	sinks []*compositeSink
+	wait  sync.WaitGroup
+}
+
+// compositeSink is one of the stores of a CompositeStore.
+type compositeSink struct {
+	name    string
+	store   PacketStore
+	options SinkOptions
+	queue   chan Packet
+
+	// packets and lastWritten are only used by WritePacket.
+	packets     int
+	lastWritten map[string]time.Time
+
+	written uint64
+	dropped uint64
+}
+
+// NewCompositeStore returns a CompositeStore with no stores.
+func NewCompositeStore() *CompositeStore {
+	return &CompositeStore{}
+}
+
+// Add starts writing packets to `store`. `name` identifies the store in logs
+// and stats. Add must not be called after WritePacket.
+func (composite *CompositeStore) Add(name string, store PacketStore, options SinkOptions) {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultSinkQueueSize
+	}
+	sink := &compositeSink{
+		name:        name,
+		store:       store,
+		options:     options,
+		queue:       make(chan Packet, options.QueueSize),
+		lastWritten: make(map[string]time.Time),
+	}
+	composite.sinks = append(composite.sinks, sink)
+	composite.wait.Add(1)
+	go func() {
+		defer composite.wait.Done()
+		for packet := range sink.queue {
+			sink.store.WritePacket(packet)
+			atomic.AddUint64(&sink.written, 1)
+		}
+	}()
+	glog.Infof("writing packets to %s", name)
+}
+
+// WritePacket queues the packet for every store that samples it.
+func (composite *CompositeStore) WritePacket(packet Packet) {
+	for _, sink := range composite.sinks {
+		if !sink.sample(packet) {
+			continue
+		}
+		filtered := packet
+		if sink.options.Whitelist != nil && packet.Measurement == packetMeasurement {
+			filtered = packet.filter(sink.options.Whitelist)
+		}
+		if sink.options.Block {
+			sink.queue <- filtered
+			continue
+		}
+		select {
+		case sink.queue <- filtered:
+		default:
+			dropped := atomic.AddUint64(&sink.dropped, 1)
+			if dropped%100 == 1 {
+				glog.Warningf("%s is falling behind, dropped %d packets", sink.name, dropped)
+			}
+		}
+	}
+}
+
+// Stats returns the counters of each store, keyed by name.
+func (composite *CompositeStore) Stats() map[string]SinkStats {
+	stats := make(map[string]SinkStats, len(composite.sinks))
+	for _, sink := range composite.sinks {
+		stats[sink.name] = SinkStats{
+			Written: atomic.LoadUint64(&sink.written),
+			Dropped: atomic.LoadUint64(&sink.dropped),
+			Queued:  uint64(len(sink.queue)),
+		}
+	}
+	return stats
+}
+
+// Healthy reports the stores that are HealthCheckers and are not healthy.
+func (composite *CompositeStore) Healthy() error {
+	var failed []string
+	for _, sink := range composite.sinks {
+		if checker, ok := sink.store.(HealthChecker); ok {
+			if err := checker.Healthy(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", sink.name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+var (
+	sinkPacketsDesc = prometheus.NewDesc("fh4server_store_packets_total",
+		"Number of packets handled for each store, by result: written or dropped because the store fell behind.",
+		[]string{"store", "result"}, nil)
+	sinkQueuedDesc = prometheus.NewDesc("fh4server_store_queued_packets",
+		"Number of packets waiting to be passed on to each store.",
+		[]string{"store"}, nil)
+)
+
+// Describe implements prometheus.Collector, so that Stats can be exported
+// once the store is registered.
+func (composite *CompositeStore) Describe(descs chan<- *prometheus.Desc) {
+	descs <- sinkPacketsDesc
+	descs <- sinkQueuedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (composite *CompositeStore) Collect(metrics chan<- prometheus.Metric) {
+	for name, stats := range composite.Stats() {
+		metrics <- prometheus.MustNewConstMetric(sinkPacketsDesc, prometheus.CounterValue, float64(stats.Written), name, "written")
+		metrics <- prometheus.MustNewConstMetric(sinkPacketsDesc, prometheus.CounterValue, float64(stats.Dropped), name, "dropped")
+		metrics <- prometheus.MustNewConstMetric(sinkQueuedDesc, prometheus.GaugeValue, float64(stats.Queued), name)
+	}
+}
+
+// Close waits for the queued packets to be passed on to the stores, then
+// closes each store that is an io.Closer. WritePacket must not be called after
+// Close.
+func (composite *CompositeStore) Close() error {
+	for _, sink := range composite.sinks {
+		close(sink.queue)
+	}
+	composite.wait.Wait()
+	var failed []string
+	for _, sink := range composite.sinks {
+		if closer, ok := sink.store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", sink.name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to close stores: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sample returns true if the packet should be written to the store. Lap and
+// session summaries are always written.
+func (sink *compositeSink) sample(packet Packet) bool {
+	if packet.Measurement != packetMeasurement {
+		return true
+	}
+	sink.packets++
+	if sink.options.Every > 1 && (sink.packets-1)%sink.options.Every != 0 {
+		return false
+	}
+	if sink.options.Interval > 0 {
+		car := packet.Tags[sourceTag]
+		if last, ok := sink.lastWritten[car]; ok && packet.Timestamp.Sub(last) < sink.options.Interval && !packet.Timestamp.Before(last) {
+			return false
+		}
+		sink.lastWritten[car] = packet.Timestamp
+	}
+	return true
+}
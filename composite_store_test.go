@@ -0,0 +1,121 @@
+package fh4server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stuckStore is a PacketStore which never returns until it is released.
+type stuckStore struct {
+	release chan struct{}
+}
+
+func (store *stuckStore) WritePacket(packet Packet) {
+	<-store.release
+}
+
+func compositePacket(timestamp time.Time, speed float32) Packet {
+	return Packet{
+		Measurement: packetMeasurement,
+		Fields:      map[string]interface{}{"speed": speed, "gear": uint8(3)},
+		Tags:        map[string]string{"car_id": "1234", sourceTag: "192.168.1.20"},
+		Timestamp:   timestamp,
+	}
+}
+
+func TestCompositeStore(t *testing.T) {
+	r := require.New(t)
+	all, sampled, throttled := newRecordingStore(), newRecordingStore(), newRecordingStore()
+	stuck := &stuckStore{release: make(chan struct{})}
+
+	composite := NewCompositeStore()
+	composite.Add("all", all, SinkOptions{})
+	composite.Add("sampled", sampled, SinkOptions{Whitelist: AllowList([]string{"speed", "lap_time"}), Every: 2})
+	composite.Add("throttled", throttled, SinkOptions{Interval: 100 * time.Millisecond})
+	composite.Add("stuck", stuck, SinkOptions{QueueSize: 2})
+
+	start := time.Unix(1559390400, 0)
+	for i := 0; i < 6; i++ {
+		composite.WritePacket(compositePacket(start.Add(time.Duration(i)*40*time.Millisecond), float32(i)))
+	}
+	composite.WritePacket(Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5, "top_speed": 50.0}})
+
+	// The stuck store does not hold up the others.
+	for i := 0; i < 6; i++ {
+		r.Equal(float32(i), all.next(r).Fields["speed"])
+	}
+	r.Equal(lapMeasurement, all.next(r).Measurement)
+
+	for _, speed := range []float32{0, 2, 4} {
+		packet := sampled.next(r)
+		r.Equal(map[string]interface{}{"speed": speed}, packet.Fields)
+		r.Empty(packet.Tags)
+	}
+	// Summaries are not whitelisted.
+	lap := sampled.next(r)
+	r.Equal(lapMeasurement, lap.Measurement)
+	r.Equal(map[string]interface{}{"lap_time": 60.5, "top_speed": 50.0}, lap.Fields)
+
+	// Packets 40ms apart, at most one per 100ms.
+	for _, speed := range []float32{0, 3} {
+		r.Equal(speed, throttled.next(r).Fields["speed"])
+	}
+	r.Equal(lapMeasurement, throttled.next(r).Measurement)
+
+	stats := composite.Stats()
+	// Up to one packet is being written and two are queued, the rest are
+	// dropped.
+	r.True(stats["stuck"].Dropped >= 4, "%+v", stats["stuck"])
+
+	close(stuck.release)
+	composite.Close()
+	stats = composite.Stats()
+	r.Equal(uint64(7), stats["all"].Written)
+	r.Equal(uint64(7), stats["stuck"].Written+stats["stuck"].Dropped)
+	r.Equal(uint64(0), stats["stuck"].Queued)
+}
+
+func TestCompositeStoreBlocks(t *testing.T) {
+	r := require.New(t)
+	stuck := &stuckStore{release: make(chan struct{})}
+	composite := NewCompositeStore()
+	composite.Add("stuck", stuck, SinkOptions{QueueSize: 1, Block: true})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4; i++ {
+			composite.WritePacket(compositePacket(time.Unix(1559390400, 0), float32(i)))
+		}
+	}()
+	select {
+	case <-done:
+		r.FailNow("WritePacket didn't wait for the store")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stuck.release)
+	<-done
+	r.NoError(composite.Close())
+	r.Equal(SinkStats{Written: 4}, composite.Stats()["stuck"])
+}
+
+func TestStoreOptionsFlag(t *testing.T) {
+	r := require.New(t)
+	options := make(StoreOptionsFlag)
+	r.NoError(options.Set("influx:every=6&interval=100ms&queue_size=50&fields=speed,car_id"))
+	r.NoError(options.Set("stream:every=2"))
+	r.Equal("influx,stream", options.String())
+
+	influx := options["influx"]
+	r.Equal(6, influx.Every)
+	r.Equal(100*time.Millisecond, influx.Interval)
+	r.Equal(50, influx.QueueSize)
+	r.True(influx.Whitelist("car_id"))
+	r.False(influx.Whitelist("gear"))
+
+	r.Error(options.Set("influx"))
+	r.Error(options.Set("influx:every=x"))
+	r.Error(options.Set("influx:rate=2"))
+}
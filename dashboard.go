@@ -0,0 +1,252 @@
+package fh4server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// dashboardFields are the fields and tags the dashboard subscribes to.
+var dashboardFields = []string{
+	"current_engine_rpm", "engine_max_rpm", "gear", "speed_kph",
+	"accel", "brake",
+	"tire_temp_front_left_celsius", "tire_temp_front_right_celsius",
+	"tire_temp_rear_left_celsius", "tire_temp_rear_right_celsius",
+	"tire_combined_slip_front_left", "tire_combined_slip_front_right",
+	"tire_combined_slip_rear_left", "tire_combined_slip_rear_right",
+	"position_x", "position_z",
+	"current_lap_time", "last_lap_time", "best_lap_time", "race_position",
+	"lap_number", "car_id", sourceTag, driverTag,
+}
+
+// serveDashboard serves the live dashboard, a single page which shows the
+// packets from the live stream.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(strings.Replace(dashboardHTML, "{{fields}}", strings.Join(dashboardFields, ","), 1)))
+}
+
+// dashboardHTML is the live dashboard page. It has no dependencies, so it
+// works without an internet connection.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>fh4server</title>
+<style>
+  body { margin: 0; background: #111; color: #ddd; font-family: sans-serif; }
+  header { display: flex; align-items: center; gap: 1em; padding: 0.5em 1em; background: #1b1b1b; }
+  header h1 { font-size: 1.1em; margin: 0; }
+  #status { color: #e55; }
+  #status.connected { color: #5c5; }
+  main { display: grid; grid-template-columns: repeat(auto-fit, minmax(340px, 1fr)); gap: 1em; padding: 1em; }
+  section { background: #1b1b1b; border-radius: 6px; padding: 0.5em; }
+  section h2 { font-size: 0.9em; margin: 0 0 0.5em; color: #999; font-weight: normal; }
+  canvas { width: 100%; display: block; }
+  dl { display: grid; grid-template-columns: auto auto; margin: 0; }
+  dt { color: #999; } dd { margin: 0; text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+<header>
+  <h1>fh4server</h1>
+  <span id="status">connecting</span>
+  <label>car <select id="car"></select></label>
+</header>
+<main>
+  <section><h2>Engine</h2><canvas id="gauge" width="340" height="220"></canvas></section>
+  <section><h2>Throttle and brake</h2><canvas id="pedals" width="340" height="220"></canvas></section>
+  <section><h2>Tires (temperature &deg;C, combined slip)</h2><canvas id="tires" width="340" height="220"></canvas></section>
+  <section><h2>Position</h2><canvas id="map" width="340" height="220"></canvas></section>
+  <section><h2>Lap</h2><dl>
+    <dt>Lap</dt><dd id="lap">-</dd>
+    <dt>Position</dt><dd id="position">-</dd>
+    <dt>Current</dt><dd id="current">-</dd>
+    <dt>Last</dt><dd id="last">-</dd>
+    <dt>Best</dt><dd id="best">-</dd>
+  </dl></section>
+</main>
+<script>
+"use strict";
+const historySeconds = 10;
+const cars = {};
+let selected = null;
+
+function carKey(message) {
+  return message.tags.source_ip || "local";
+}
+
+function carName(key, message) {
+  return message.tags.driver || (key === "local" ? "this server" : key);
+}
+
+function onPacket(message) {
+  const key = carKey(message);
+  let car = cars[key];
+  if (!car) {
+    car = cars[key] = { fields: {}, tags: {}, pedals: [], trail: [] };
+    const option = document.createElement("option");
+    option.value = key;
+    option.textContent = carName(key, message);
+    document.getElementById("car").appendChild(option);
+    if (selected === null) selected = key;
+  }
+  if (message.measurement !== "fh4") return;
+  car.fields = message.fields;
+  car.tags = message.tags;
+  const t = Date.parse(message.timestamp) / 1000;
+  car.pedals.push([t, (message.fields.accel || 0) / 255, (message.fields.brake || 0) / 255]);
+  while (car.pedals.length && car.pedals[0][0] < t - historySeconds) car.pedals.shift();
+  const x = message.fields.position_x, z = message.fields.position_z;
+  const last = car.trail[car.trail.length - 1];
+  if (x !== undefined && (!last || Math.hypot(last[0] - x, last[1] - z) > 2)) {
+    car.trail.push([x, z]);
+    if (car.trail.length > 5000) car.trail.shift();
+  }
+}
+
+function canvas(id) {
+  const c = document.getElementById(id);
+  const ctx = c.getContext("2d");
+  ctx.clearRect(0, 0, c.width, c.height);
+  ctx.font = "14px sans-serif";
+  return [c, ctx];
+}
+
+function drawGauge(f) {
+  const [c, ctx] = canvas("gauge");
+  const cx = c.width / 2, cy = 130, r = 100;
+  const max = f.engine_max_rpm || 8000, rpm = f.current_engine_rpm || 0;
+  const start = 0.75 * Math.PI, sweep = 1.5 * Math.PI;
+  ctx.lineWidth = 14;
+  ctx.strokeStyle = "#333";
+  ctx.beginPath(); ctx.arc(cx, cy, r, start, start + sweep); ctx.stroke();
+  ctx.strokeStyle = "#a22";
+  ctx.beginPath(); ctx.arc(cx, cy, r, start + sweep * 0.9, start + sweep); ctx.stroke();
+  ctx.strokeStyle = rpm / max > 0.9 ? "#e33" : "#4af";
+  ctx.beginPath(); ctx.arc(cx, cy, r, start, start + sweep * Math.min(rpm / max, 1)); ctx.stroke();
+  ctx.fillStyle = "#ddd";
+  ctx.textAlign = "center";
+  ctx.font = "48px sans-serif";
+  ctx.fillText(f.gear === 0 ? "R" : (f.gear === undefined ? "-" : f.gear), cx, cy + 10);
+  ctx.font = "20px sans-serif";
+  ctx.fillText(Math.round(f.speed_kph || 0) + " km/h", cx, cy + 45);
+  ctx.font = "14px sans-serif";
+  ctx.fillText(Math.round(rpm) + " rpm", cx, cy + 70);
+}
+
+function drawPedals(car) {
+  const [c, ctx] = canvas("pedals");
+  const points = car.pedals;
+  if (!points.length) return;
+  const end = points[points.length - 1][0];
+  const x = t => c.width * (1 - (end - t) / historySeconds);
+  const y = v => c.height - 10 - v * (c.height - 20);
+  [[1, "#5c5"], [2, "#e55"]].forEach(([i, color]) => {
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    points.forEach((p, j) => j ? ctx.lineTo(x(p[0]), y(p[i])) : ctx.moveTo(x(p[0]), y(p[i])));
+    ctx.stroke();
+  });
+}
+
+function tireColor(celsius) {
+  // Blue when cold, green around 90C, red when hot.
+  const t = Math.max(0, Math.min(1, ((celsius || 0) - 40) / 100));
+  const hue = 240 - 240 * t;
+  return "hsl(" + hue + ", 70%, 45%)";
+}
+
+function drawTires(f) {
+  const [c, ctx] = canvas("tires");
+  const corners = [["front_left", 0, 0], ["front_right", 1, 0], ["rear_left", 0, 1], ["rear_right", 1, 1]];
+  const w = 110, h = 90, ox = (c.width - 2 * w - 40) / 2;
+  corners.forEach(([name, col, row]) => {
+    const x = ox + col * (w + 40), y = 10 + row * (h + 20);
+    const temp = f["tire_temp_" + name + "_celsius"];
+    const slip = f["tire_combined_slip_" + name] || 0;
+    ctx.fillStyle = tireColor(temp);
+    ctx.fillRect(x, y, w, h);
+    ctx.strokeStyle = Math.abs(slip) > 1 ? "#fff" : "#000";
+    ctx.lineWidth = Math.abs(slip) > 1 ? 4 : 1;
+    ctx.strokeRect(x, y, w, h);
+    ctx.fillStyle = "#fff";
+    ctx.textAlign = "center";
+    ctx.fillText(temp === undefined ? "-" : Math.round(temp) + "°C", x + w / 2, y + h / 2 - 4);
+    ctx.fillText("slip " + slip.toFixed(2), x + w / 2, y + h / 2 + 16);
+  });
+}
+
+function drawMap(car) {
+  const [c, ctx] = canvas("map");
+  const trail = car.trail;
+  if (!trail.length) return;
+  let minX = Infinity, maxX = -Infinity, minZ = Infinity, maxZ = -Infinity;
+  trail.forEach(([x, z]) => {
+    minX = Math.min(minX, x); maxX = Math.max(maxX, x);
+    minZ = Math.min(minZ, z); maxZ = Math.max(maxZ, z);
+  });
+  const scale = Math.min((c.width - 20) / (maxX - minX || 1), (c.height - 20) / (maxZ - minZ || 1));
+  const px = x => 10 + (x - minX) * scale, pz = z => c.height - 10 - (z - minZ) * scale;
+  ctx.strokeStyle = "#666";
+  ctx.lineWidth = 2;
+  ctx.beginPath();
+  trail.forEach(([x, z], i) => i ? ctx.lineTo(px(x), pz(z)) : ctx.moveTo(px(x), pz(z)));
+  ctx.stroke();
+  const [x, z] = trail[trail.length - 1];
+  ctx.fillStyle = "#4af";
+  ctx.beginPath(); ctx.arc(px(x), pz(z), 6, 0, 2 * Math.PI); ctx.fill();
+}
+
+function formatTime(seconds) {
+  if (!seconds) return "-";
+  const minutes = Math.floor(seconds / 60);
+  return minutes + ":" + (seconds - minutes * 60).toFixed(3).padStart(6, "0");
+}
+
+function drawLap(car) {
+  const f = car.fields;
+  document.getElementById("lap").textContent = car.tags.lap_number || "-";
+  document.getElementById("position").textContent = f.race_position || "-";
+  document.getElementById("current").textContent = formatTime(f.current_lap_time);
+  document.getElementById("last").textContent = formatTime(f.last_lap_time);
+  document.getElementById("best").textContent = formatTime(f.best_lap_time);
+}
+
+function draw() {
+  const car = cars[selected];
+  if (car) {
+    drawGauge(car.fields);
+    drawPedals(car);
+    drawTires(car.fields);
+    drawMap(car);
+    drawLap(car);
+  }
+  requestAnimationFrame(draw);
+}
+
+function connect() {
+  const status = document.getElementById("status");
+  const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  const socket = new WebSocket(scheme + location.host + "/stream?fields={{fields}}");
+  socket.onopen = () => { status.textContent = "connected"; status.className = "connected"; };
+  socket.onmessage = event => onPacket(JSON.parse(event.data));
+  socket.onclose = () => {
+    status.textContent = "disconnected, retrying";
+    status.className = "";
+    setTimeout(connect, 2000);
+  };
+}
+
+document.getElementById("car").onchange = event => { selected = event.target.value; };
+connect();
+requestAnimationFrame(draw);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,72 @@
+package fh4server
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+var driverNames = make(DriverNames)
+
+func init() {
+	flag.Var(driverNames, "driver_names", "comma separated list of ip=name pairs, e.g. 192.168.1.20=alice,192.168.1.21=rig2. "+
+		"Packets sent from each ip are tagged with the driver or rig name. Can be repeated.")
+}
+
+// Tags added to packets to tell apart the cars sending to one server.
+const (
+	// sourceTag holds the IP address that a packet was sent from.
+	sourceTag = "source_ip"
+	// driverTag holds the name of the driver or rig that the IP address
+	// belongs to, from -driver_names.
+	driverTag = "driver"
+)
+
+// DriverNames maps the IP addresses that packets are sent from to the name of
+// the driver or rig. It implements flag.Value.
+type DriverNames map[string]string
+
+// String returns the names in the format accepted by Set.
+func (names DriverNames) String() string {
+	var pairs []string
+	for ip, name := range names {
+		pairs = append(pairs, ip+"="+name)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a comma separated list of ip=name pairs.
+func (names DriverNames) Set(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("expected ip=name, got %q", pair)
+		}
+		ip := net.ParseIP(parts[0])
+		if ip == nil {
+			return fmt.Errorf("invalid ip address %q", parts[0])
+		}
+		names[ip.String()] = parts[1]
+	}
+	return nil
+}
+
+// tag adds the source_ip and driver tags for a packet sent from `source`.
+// Nothing is added if the source is not known.
+func (names DriverNames) tag(packet *Packet, source *net.UDPAddr) {
+	if source == nil {
+		return
+	}
+	ip := source.IP.String()
+	packet.Tags[sourceTag] = ip
+	if name, ok := names[ip]; ok {
+		packet.Tags[driverTag] = name
+	}
+}
@@ -0,0 +1,73 @@
+package fh4server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriverNames(t *testing.T) {
+	r := require.New(t)
+	names := make(DriverNames)
+	r.NoError(names.Set("192.168.1.20=alice, 192.168.1.21=rig 2"))
+	r.NoError(names.Set("fd00:0::20=bob"))
+	r.Equal("192.168.1.20=alice,192.168.1.21=rig 2,fd00::20=bob", names.String())
+
+	r.Error(names.Set("192.168.1.22"))
+	r.Error(names.Set("xbox=carol"))
+}
+
+// addressedPacket is a packet along with the address it was sent from.
+type addressedPacket struct {
+	packet []byte
+	source *net.UDPAddr
+}
+
+// multiCarPacketSource is a PacketSource which returns packets sent from
+// several addresses.
+type multiCarPacketSource struct {
+	packets []addressedPacket
+}
+
+func (source *multiCarPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	if len(source.packets) == 0 {
+		return nil, PacketMetadata{}, io.EOF
+	}
+	next := source.packets[0]
+	source.packets = source.packets[1:]
+	return bytes.NewBuffer(next.packet), PacketMetadata{Source: next.source, Length: len(next.packet)}, nil
+}
+
+func TestRunTagsEachCar(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	alice := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}
+	unnamed := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 21), Port: 50000}
+
+	defer func(names DriverNames) { driverNames = names }(driverNames)
+	driverNames = DriverNames{"192.168.1.20": "alice"}
+
+	store := newRecordingStore()
+	err = Run(context.Background(), AllowAll(), &multiCarPacketSource{packets: []addressedPacket{
+		{packetBytes, alice},
+		{packetBytes, unnamed},
+		{packetBytes, alice},
+	}}, store)
+	r.NoError(err)
+
+	first, second, third := store.next(r), store.next(r), store.next(r)
+	r.Equal("192.168.1.20", first.Tags[sourceTag])
+	r.Equal("alice", first.Tags[driverTag])
+	r.Equal("192.168.1.21", second.Tags[sourceTag])
+	r.NotContains(second.Tags, driverTag)
+	// Each car has its own session.
+	r.Contains(first.Tags[sessionTag], "-alice-")
+	r.NotEqual(first.Tags[sessionTag], second.Tags[sessionTag])
+	r.Equal(first.Tags[sessionTag], third.Tags[sessionTag])
+}
@@ -0,0 +1,410 @@
+package fh4server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	csvDir             = flag.String("csv_dir", "", "when set, packets are also written to CSV files in this directory, with a column for every field and tag.")
+	ndjsonDir          = flag.String("ndjson_dir", "", "when set, packets, laps and sessions are also written to newline-delimited JSON files in this directory.")
+	fileMaxSize        = flag.Int64("file_max_size", 100*1024*1024, "with -csv_dir or -ndjson_dir, a new file is started once a file is this many bytes. 0 means no limit.")
+	fileRotateInterval = flag.Duration("file_rotate_interval", 0, "with -csv_dir or -ndjson_dir, a new file is started once a file spans this much time, e.g. 1h. 0 means no limit.")
+	fileRotateSession  = flag.Bool("file_rotate_session", false, "with -csv_dir or -ndjson_dir, each session is written to its own files.")
+	fileGzip           = flag.Bool("file_gzip", false, "with -csv_dir or -ndjson_dir, files are gzipped.")
+)
+
+// FileOptions configures a FileStore.
+type FileOptions struct {
+	// Dir is the directory files are written to.
+	Dir string
+	// MaxSize is the number of bytes after which a file is closed and a new
+	// one started. With Gzip, this is the compressed size. 0 means no limit.
+	MaxSize int64
+	// RotateInterval is the span of packet time after which a file is closed
+	// and a new one started. 0 means no limit.
+	RotateInterval time.Duration
+	// RotateSession writes each session to its own files, which are closed
+	// when the session's summary is written.
+	RotateSession bool
+	// Gzip compresses the files.
+	Gzip bool
+}
+
+// FileOptionsFromFlags returns the FileOptions given by the -file_* flags,
+// writing to dir.
+func FileOptionsFromFlags(dir string) FileOptions {
+	return FileOptions{
+		Dir:            dir,
+		MaxSize:        *fileMaxSize,
+		RotateInterval: *fileRotateInterval,
+		RotateSession:  *fileRotateSession,
+		Gzip:           *fileGzip,
+	}
+}
+
+// fileEncoder is the format of a FileStore.
+type fileEncoder interface {
+	// extension is the file name extension of the format, without gzip.
+	extension() string
+	// writes returns whether the format has room for the packet.
+	writes(packet Packet) bool
+	// open starts a file written to w, writing its header if the format has
+	// one.
+	open(w io.Writer) (fileWriter, error)
+}
+
+// fileWriter writes packets to one file of a FileStore.
+type fileWriter interface {
+	write(packet Packet) error
+}
+
+// csvEncoder writes packets as CSV rows, with a header row naming the
+// columns. Columns are time, then definitionColumns, then extra.
+type csvEncoder struct {
+	columns []packetColumn
+}
+
+// csvFileWriter writes the rows of one CSV file.
+type csvFileWriter struct {
+	columns []packetColumn
+	writer  *csv.Writer
+	record  []string
+}
+
+func (encoder *csvEncoder) extension() string {
+	return ".csv"
+}
+
+// writes returns false for lap and session summaries, which have other
+// columns.
+func (encoder *csvEncoder) writes(packet Packet) bool {
+	return packet.Measurement == "" || packet.Measurement == packetMeasurement
+}
+
+func (encoder *csvEncoder) open(w io.Writer) (fileWriter, error) {
+	writer := &csvFileWriter{
+		columns: encoder.columns,
+		writer:  csv.NewWriter(w),
+		record:  make([]string, 0, len(encoder.columns)+2),
+	}
+	header := []string{"time"}
+	for _, column := range encoder.columns {
+		header = append(header, column.name)
+	}
+	return writer, writer.flush(append(header, "extra"))
+}
+
+func (writer *csvFileWriter) write(packet Packet) error {
+	values, extra := finiteColumnValues(packet, writer.columns)
+	record := append(writer.record[:0], packet.Timestamp.UTC().Format(time.RFC3339Nano))
+	for _, value := range values {
+		record = append(record, csvValue(value))
+	}
+	if extra != nil {
+		record = append(record, extra.(string))
+	} else {
+		record = append(record, "")
+	}
+	return writer.flush(record)
+}
+
+// flush writes the record through to the file's buffer, so that the file's
+// size is up to date.
+func (writer *csvFileWriter) flush(record []string) error {
+	writer.writer.Write(record)
+	writer.writer.Flush()
+	return writer.writer.Error()
+}
+
+// csvValue formats a value for a CSV cell. Missing values are empty.
+func csvValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float32:
+		return strconv.FormatFloat(float64(value), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// ndjsonEncoder writes each packet as a JSON object on its own line.
+type ndjsonEncoder struct{}
+
+// ndjsonFileWriter writes the lines of one newline-delimited JSON file.
+type ndjsonFileWriter struct {
+	w io.Writer
+}
+
+// ndjsonPacket is the JSON object written for each packet.
+type ndjsonPacket struct {
+	Time        time.Time              `json:"time"`
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+func (encoder ndjsonEncoder) extension() string {
+	return ".ndjson"
+}
+
+func (encoder ndjsonEncoder) writes(packet Packet) bool {
+	return true
+}
+
+func (encoder ndjsonEncoder) open(w io.Writer) (fileWriter, error) {
+	return ndjsonFileWriter{w: w}, nil
+}
+
+// write writes the packet as a line of JSON. NaN and infinite fields, which
+// JSON can't represent, are left out.
+func (writer ndjsonFileWriter) write(packet Packet) error {
+	measurement := packet.Measurement
+	if measurement == "" {
+		measurement = packetMeasurement
+	}
+	line, err := json.Marshal(ndjsonPacket{Time: packet.Timestamp.UTC(), Measurement: measurement, Tags: packet.Tags, Fields: finiteFields(packet.Fields)})
+	if err != nil {
+		return fmt.Errorf("failed to encode packet: %v", err)
+	}
+	_, err = writer.w.Write(append(line, '\n'))
+	return err
+}
+
+// FileStore implements PacketStore by writing packets to rotating files, as
+// CSV or newline-delimited JSON, for importing into spreadsheets and
+// analysis tools.
+//
+// Files are named after the time of their first packet, and with
+// RotateSession the session, e.g. fh4-20190601T120000.000-20190601T120000-1234.csv.gz.
+type FileStore struct {
+	options FileOptions
+	encoder fileEncoder
+
+	mu sync.Mutex
+	// files holds the open files, by session with RotateSession, or under ""
+	// otherwise.
+	files *fileRotation
+	// lastErr is the error returned by the most recent write.
+	lastErr error
+}
+
+// encodedFile is a file of a FileStore which is being written.
+type encodedFile struct {
+	path    string
+	file    *os.File
+	counter *countingWriter
+	gzip    *gzip.Writer
+	buffer  *bufio.Writer
+	packets fileWriter
+	// first is the time of the first packet written.
+	first time.Time
+	// maxSize is FileOptions.MaxSize.
+	maxSize int64
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.w.Write(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+// NewCSVStoreFromFlags returns a FileStore writing CSV to -csv_dir, or nil if
+// it is not set.
+func NewCSVStoreFromFlags() (*FileStore, error) {
+	if *csvDir == "" {
+		return nil, nil
+	}
+	return NewCSVStore(FileOptionsFromFlags(*csvDir))
+}
+
+// NewNDJSONStoreFromFlags returns a FileStore writing newline-delimited JSON
+// to -ndjson_dir, or nil if it is not set.
+func NewNDJSONStoreFromFlags() (*FileStore, error) {
+	if *ndjsonDir == "" {
+		return nil, nil
+	}
+	return NewNDJSONStore(FileOptionsFromFlags(*ndjsonDir))
+}
+
+// NewCSVStore creates a store which writes packets to CSV files, with a
+// column for every field and tag of the packet definition, in the order of
+// the definition. The packet definition must be loaded first. Lap and session
+// summaries are not written.
+func NewCSVStore(options FileOptions) (*FileStore, error) {
+	return newFileStore(options, &csvEncoder{columns: definitionColumns()})
+}
+
+// NewNDJSONStore creates a store which writes packets, and lap and session
+// summaries, to newline-delimited JSON files.
+func NewNDJSONStore(options FileOptions) (*FileStore, error) {
+	return newFileStore(options, ndjsonEncoder{})
+}
+
+func newFileStore(options FileOptions, encoder fileEncoder) (*FileStore, error) {
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", options.Dir, err)
+	}
+	glog.Infof("writing packets to %s files in %s", strings.TrimPrefix(encoder.extension(), "."), options.Dir)
+	return &FileStore{
+		options: options,
+		encoder: encoder,
+		files:   newFileRotation(options.RotateInterval),
+	}, nil
+}
+
+// WritePacket appends the packet to the current file, starting a new one if
+// the current one is due to be rotated.
+func (store *FileStore) WritePacket(packet Packet) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	err := store.writePacket(packet)
+	if err != nil {
+		glog.Warningf("failed to write packet to %s: %v", store.options.Dir, err)
+	}
+	store.lastErr = err
+}
+
+func (store *FileStore) writePacket(packet Packet) error {
+	var session string
+	if store.options.RotateSession {
+		session = packet.Tags[sessionTag]
+	}
+	// The session is over once its summary is written.
+	sessionEnd := store.options.RotateSession && session != "" && packet.Measurement == sessionMeasurement
+	if !store.encoder.writes(packet) {
+		if sessionEnd {
+			return store.files.end(session)
+		}
+		return nil
+	}
+	current, err := store.files.current(session, packet.Timestamp)
+	if err != nil {
+		return err
+	}
+	file, _ := current.(*encodedFile)
+	if file == nil {
+		file, err = store.create(session, packet.Timestamp)
+		if err != nil {
+			return err
+		}
+		store.files.start(session, file)
+	}
+	if err := file.packets.write(packet); err != nil {
+		return err
+	}
+	if sessionEnd {
+		return store.files.end(session)
+	}
+	return nil
+}
+
+// create starts a new file, named after the time of its first packet and the
+// session, and writes the header.
+func (store *FileStore) create(session string, first time.Time) (*encodedFile, error) {
+	name := "fh4-" + first.UTC().Format("20060102T150405.000")
+	if session != "" {
+		name += "-" + url.PathEscape(session)
+	}
+	extension := store.encoder.extension()
+	if store.options.Gzip {
+		extension += ".gz"
+	}
+	path, err := uniquePath(store.options.Dir, name, extension)
+	if err != nil {
+		return nil, err
+	}
+	osFile, err := createUnique(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &encodedFile{path: path, file: osFile, counter: &countingWriter{w: osFile}, first: first, maxSize: store.options.MaxSize}
+	var w io.Writer = file.counter
+	if store.options.Gzip {
+		file.gzip = gzip.NewWriter(w)
+		w = file.gzip
+	}
+	file.buffer = bufio.NewWriter(w)
+	if file.packets, err = store.encoder.open(file.buffer); err != nil {
+		file.close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *encodedFile) started() time.Time {
+	return file.first
+}
+
+func (file *encodedFile) full() bool {
+	return file.maxSize > 0 && file.size() >= file.maxSize
+}
+
+// size returns the number of bytes written to the file so far, including
+// buffered bytes unless the file is gzipped.
+func (file *encodedFile) size() int64 {
+	if file.gzip != nil {
+		return file.counter.count
+	}
+	return file.counter.count + int64(file.buffer.Buffered())
+}
+
+func (file *encodedFile) close() error {
+	var err error
+	if flushErr := file.buffer.Flush(); flushErr != nil {
+		err = flushErr
+	}
+	if file.gzip != nil {
+		if closeErr := file.gzip.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := file.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", file.path, err)
+	}
+	return nil
+}
+
+// Close completes every open file.
+func (store *FileStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.files.close()
+}
+
+// Healthy returns the error of the most recent write, if it failed.
+func (store *FileStore) Healthy() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lastErr != nil {
+		return fmt.Errorf("last write failed: %v", store.lastErr)
+	}
+	return nil
+}
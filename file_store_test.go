@@ -0,0 +1,162 @@
+package fh4server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readTestFiles returns the names of the files in dir.
+func readTestFiles(r *require.Assertions, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	r.NoError(err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestCSVStore(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "csv")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewCSVStore(FileOptions{Dir: dir, RotateSession: true, Gzip: true})
+	r.NoError(err)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	start := time.Unix(1559390400, 0)
+	write := func(session string, offset time.Duration) Packet {
+		packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+		r.NoError(err)
+		packet.Timestamp = start.Add(offset)
+		packet.Tags[sessionTag] = session
+		packet.Fields["unknown"] = float32(0.5)
+		packet.Fields["unknown_nan"] = math.NaN()
+		packet.Fields["speed"] = float32(math.Inf(1))
+		store.WritePacket(packet)
+		return packet
+	}
+	packet := write("first", 0)
+	write("first", time.Second)
+	tags := map[string]string{sessionTag: "first"}
+	store.WritePacket(Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5}, Tags: tags, Timestamp: start.Add(time.Second)})
+	store.WritePacket(Packet{Measurement: sessionMeasurement, Fields: map[string]interface{}{"laps": 1}, Tags: tags, Timestamp: start.Add(time.Second)})
+	// The first session's file is complete once its summary is written.
+	file, err := os.Open(filepath.Join(dir, "fh4-20190601T120000.000-first.csv.gz"))
+	r.NoError(err)
+	defer file.Close()
+	write("second/lap", 2*time.Second)
+	r.NoError(store.Healthy())
+	r.NoError(store.Close())
+	r.Equal([]string{"fh4-20190601T120000.000-first.csv.gz", "fh4-20190601T120002.000-second%2Flap.csv.gz"}, readTestFiles(r, dir))
+
+	gzipReader, err := gzip.NewReader(file)
+	r.NoError(err)
+	records, err := csv.NewReader(gzipReader).ReadAll()
+	r.NoError(err)
+	r.Len(records, 3)
+	header := records[0]
+	r.Equal("time", header[0])
+	r.Equal("extra", header[len(header)-1])
+	// The columns are in packet definition order, with derived values after
+	// the element they come from, and the tags added by Run last.
+	var expected []string
+	for _, column := range definitionColumns() {
+		expected = append(expected, column.name)
+	}
+	r.Equal(expected, header[1:len(header)-1])
+	r.Equal("is_race_on", header[1])
+	r.Equal(driverTag, header[len(header)-2])
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	r.Equal(columns["speed"]+1, columns["speed_kph"])
+	r.Less(columns["engine_max_rpm"], columns["speed"])
+
+	row := make(map[string]string)
+	for i, name := range header {
+		row[name] = records[1][i]
+	}
+	r.Equal("2019-06-01T12:00:00Z", row["time"])
+	r.Equal(packet.Tags["car_id"], row["car_id"])
+	r.Equal("first", row[sessionTag])
+	r.Equal("", row[sourceTag])
+	// NaN and infinite values are written as empty values, and left out of
+	// the extra values.
+	r.Equal("", row["speed"])
+	r.JSONEq(`{"fields":{"unknown":0.5}}`, row["extra"])
+}
+
+func TestNDJSONStore(t *testing.T) {
+	r := require.New(t)
+	start := time.Unix(1559390400, 0)
+	packets := []Packet{
+		{Fields: map[string]interface{}{"speed": float32(1.5), "boost": math.NaN()}, Tags: map[string]string{"car_id": "1234"}, Timestamp: start},
+		{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5}, Timestamp: start.Add(30 * time.Second)},
+		{Fields: map[string]interface{}{"speed": float32(2)}, Timestamp: start.Add(time.Minute)},
+	}
+	for _, test := range []struct {
+		name    string
+		options FileOptions
+		files   []string
+	}{
+		{"size", FileOptions{MaxSize: 1}, []string{"fh4-20190601T120000.000.ndjson", "fh4-20190601T120030.000.ndjson", "fh4-20190601T120100.000.ndjson"}},
+		{"time", FileOptions{RotateInterval: time.Minute}, []string{"fh4-20190601T120000.000.ndjson", "fh4-20190601T120100.000.ndjson"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := require.New(t)
+			dir, err := ioutil.TempDir("", "ndjson")
+			r.NoError(err)
+			defer os.RemoveAll(dir)
+			test.options.Dir = dir
+			store, err := NewNDJSONStore(test.options)
+			r.NoError(err)
+			for _, packet := range packets {
+				store.WritePacket(packet)
+			}
+			r.NoError(store.Close())
+			r.Equal(test.files, readTestFiles(r, dir))
+		})
+	}
+
+	dir, err := ioutil.TempDir("", "ndjson")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	store, err := NewNDJSONStore(FileOptions{Dir: dir})
+	r.NoError(err)
+	for _, packet := range packets {
+		store.WritePacket(packet)
+	}
+	r.NoError(store.Close())
+	file, err := os.Open(filepath.Join(dir, "fh4-20190601T120000.000.ndjson"))
+	r.NoError(err)
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	r.NoError(scanner.Err())
+	r.Len(lines, 3)
+	// NaN, which JSON can't represent, is left out.
+	r.JSONEq(`{"time":"2019-06-01T12:00:00Z","measurement":"fh4","tags":{"car_id":"1234"},"fields":{"speed":1.5}}`, lines[0])
+	var lap ndjsonPacket
+	r.NoError(json.Unmarshal([]byte(lines[1]), &lap))
+	r.Equal(lapMeasurement, lap.Measurement)
+	r.Equal(60.5, lap.Fields["lap_time"])
+}
@@ -0,0 +1,122 @@
+package fh4server
+
+import (
+	"fmt"
+	"math"
+)
+
+// finisher converts a parsed value before it is stored, e.g. from one unit to
+// another. Finishers receive the value as returned by the element's parse
+// function.
+type finisher func(interface{}) interface{}
+
+// finishers holds every finisher that can be attached to a packetElement,
+// keyed by the name used in packet definitions.
+var finishers = map[string]finisher{
+	"int_to_bool":           intToBool,
+	"mps_to_kph":            scale(3.6),
+	"mps_to_mph":            scale(2.2369363),
+	"watts_to_hp":           scale(1 / 745.69987),
+	"rad_per_sec_to_rpm":    scale(60 / (2 * math.Pi)),
+	"fahrenheit_to_celsius": fahrenheitToCelsius,
+}
+
+// inverseFinishers undo the finisher of the same name, so that finished values
+// can be encoded back into packets. Finishers without an inverse can't be
+// encoded.
+var inverseFinishers = map[string]finisher{
+	"int_to_bool":           boolToInt,
+	"mps_to_kph":            scale(1 / 3.6),
+	"mps_to_mph":            scale(1 / 2.2369363),
+	"watts_to_hp":           scale(745.69987),
+	"rad_per_sec_to_rpm":    scale(2 * math.Pi / 60),
+	"fahrenheit_to_celsius": celsiusToFahrenheit,
+}
+
+func lookupFinisher(name string) (finisher, error) {
+	f, ok := finishers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown finisher %q", name)
+	}
+	return f, nil
+}
+
+func mustLookupFinisher(name string) finisher {
+	f, err := lookupFinisher(name)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// toFloat64 converts any of the values produced by parse functions, or found
+// in summaries, to a float64.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// intToBool returns true for any non-zero number.
+func intToBool(value interface{}) interface{} {
+	v, ok := toFloat64(value)
+	if !ok {
+		return nil
+	}
+	return v != 0
+}
+
+// boolToInt returns 1 for true and 0 for false.
+func boolToInt(value interface{}) interface{} {
+	v, ok := value.(bool)
+	if !ok {
+		return nil
+	}
+	if v {
+		return int32(1)
+	}
+	return int32(0)
+}
+
+// scale returns a finisher which multiplies numbers by `factor`.
+func scale(factor float64) finisher {
+	return func(value interface{}) interface{} {
+		v, ok := toFloat64(value)
+		if !ok {
+			return nil
+		}
+		return float32(v * factor)
+	}
+}
+
+func fahrenheitToCelsius(value interface{}) interface{} {
+	v, ok := toFloat64(value)
+	if !ok {
+		return nil
+	}
+	return float32((v - 32) * 5 / 9)
+}
+
+func celsiusToFahrenheit(value interface{}) interface{} {
+	v, ok := toFloat64(value)
+	if !ok {
+		return nil
+	}
+	return float32(v*9/5 + 32)
+}
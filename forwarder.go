@@ -0,0 +1,150 @@
+package fh4server
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var (
+	forwardTo = flag.String("forward_to", "", "comma separated list of host:port UDP endpoints that every packet received from the game is relayed to, unmodified. "+
+		"Each endpoint can be followed by options, e.g. 192.168.1.20:20777?every=3&format=fh4 relays every third FH4 packet. "+
+		"format can be repeated, and packets of any format are relayed if it is not given.")
+)
+
+// ForwardTarget is a downstream UDP endpoint that packets are relayed to.
+type ForwardTarget struct {
+	// Addr is the host:port of the endpoint.
+	Addr string
+	// Every relays one in every `Every` packets, to reduce the packet rate.
+	// 0 and 1 relay every packet.
+	Every int
+	// Formats, if not empty, limits relayed packets to these packet formats.
+	Formats []string
+}
+
+// ParseForwardTargets parses the comma separated list of endpoints used by the
+// -forward_to flag.
+func ParseForwardTargets(spec string) ([]ForwardTarget, error) {
+	var targets []ForwardTarget
+	for _, endpoint := range strings.Split(spec, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		target := ForwardTarget{Addr: endpoint}
+		if i := strings.Index(endpoint, "?"); i >= 0 {
+			target.Addr = endpoint[:i]
+			options, err := url.ParseQuery(endpoint[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid options for %s: %v", target.Addr, err)
+			}
+			for name, values := range options {
+				switch name {
+				case "every":
+					target.Every, err = strconv.Atoi(values[len(values)-1])
+					if err != nil || target.Every < 0 {
+						return nil, fmt.Errorf("invalid every=%s for %s", values[len(values)-1], target.Addr)
+					}
+				case "format":
+					target.Formats = append(target.Formats, values...)
+				default:
+					return nil, fmt.Errorf("unknown option %q for %s", name, target.Addr)
+				}
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Forwarder relays raw packets to a list of downstream UDP endpoints, so that
+// other telemetry apps keep working while the game sends its data to
+// fh4server.
+type Forwarder struct {
+	conn    *net.UDPConn
+	targets []*forwardTarget
+}
+
+type forwardTarget struct {
+	ForwardTarget
+	udpAddr *net.UDPAddr
+	formats map[string]bool
+	// counts is the number of packets that matched the format filter, by the
+	// IP address they were sent from, so that each car is decimated
+	// separately.
+	counts map[string]int
+}
+
+// NewForwarderFromFlags sets up a Forwarder for the endpoints given by
+// -forward_to. It returns nil if the flag is not set.
+func NewForwarderFromFlags() (*Forwarder, error) {
+	targets, err := ParseForwardTargets(*forwardTo)
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+	return NewForwarder(targets)
+}
+
+// NewForwarder resolves the targets and opens the socket used to send to
+// them.
+func NewForwarder(targets []ForwardTarget) (*Forwarder, error) {
+	forwarder := &Forwarder{}
+	for _, target := range targets {
+		udpAddr, err := net.ResolveUDPAddr("udp", target.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve forwarding address %s: %v", target.Addr, err)
+		}
+		formats := make(map[string]bool)
+		for _, format := range target.Formats {
+			if _, ok := packetFormats[format]; !ok {
+				return nil, fmt.Errorf("%w %q for %s", ErrUnknownFormat, format, target.Addr)
+			}
+			formats[format] = true
+		}
+		forwarder.targets = append(forwarder.targets, &forwardTarget{ForwardTarget: target, udpAddr: udpAddr, formats: formats, counts: make(map[string]int)})
+		glog.Infof("forwarding packets to %v", udpAddr)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open forwarding socket: %v", err)
+	}
+	forwarder.conn = conn
+	return forwarder, nil
+}
+
+// Forward relays a packet sent from `source` to every target that accepts it.
+// Failing to send is logged, but does not stop the packet being sent to the
+// other targets.
+func (forwarder *Forwarder) Forward(packet []byte, source *net.UDPAddr) {
+	formatName := ""
+	if format := lookupPacketFormat(len(packet)); format != nil {
+		formatName = format.name
+	}
+	var sourceIP string
+	if source != nil {
+		sourceIP = source.IP.String()
+	}
+	for _, target := range forwarder.targets {
+		if len(target.formats) > 0 && !target.formats[formatName] {
+			continue
+		}
+		target.counts[sourceIP]++
+		if target.Every > 1 && (target.counts[sourceIP]-1)%target.Every != 0 {
+			continue
+		}
+		if _, err := forwarder.conn.WriteToUDP(packet, target.udpAddr); err != nil {
+			glog.V(1).Infof("failed to forward packet to %v: %v", target.udpAddr, err)
+		}
+	}
+}
+
+// Close should be called when the Forwarder is no longer needed.
+func (forwarder *Forwarder) Close() error {
+	return forwarder.conn.Close()
+}
@@ -0,0 +1,91 @@
+package fh4server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwardTargets(t *testing.T) {
+	r := require.New(t)
+	targets, err := ParseForwardTargets("10.0.0.5:20777, 10.0.0.6:5300?every=3&format=fh4&format=fm7_dash,")
+	r.NoError(err)
+	r.Equal([]ForwardTarget{
+		{Addr: "10.0.0.5:20777"},
+		{Addr: "10.0.0.6:5300", Every: 3, Formats: []string{"fh4", "fm7_dash"}},
+	}, targets)
+
+	_, err = ParseForwardTargets("10.0.0.5:20777?every=x")
+	r.Error(err)
+	_, err = ParseForwardTargets("10.0.0.5:20777?rate=2")
+	r.Error(err)
+}
+
+// listenUDP opens a local UDP socket for a forwarding test.
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	return conn
+}
+
+// receiveSizes returns the sizes of the packets received by `conn` until no
+// packet arrives for a short while.
+func receiveSizes(conn *net.UDPConn) []int {
+	var sizes []int
+	buf := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return sizes
+		}
+		sizes = append(sizes, n)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	r := require.New(t)
+	all, decimated := listenUDP(t), listenUDP(t)
+	defer all.Close()
+	defer decimated.Close()
+
+	forwarder, err := NewForwarder([]ForwardTarget{
+		{Addr: all.LocalAddr().String()},
+		{Addr: decimated.LocalAddr().String(), Every: 2, Formats: []string{FormatFH4}},
+	})
+	r.NoError(err)
+	defer forwarder.Close()
+
+	for i := 0; i < 3; i++ {
+		forwarder.Forward(make([]byte, fh4PacketSize), nil)
+		forwarder.Forward(make([]byte, fm7SledPacketSize), nil)
+	}
+	r.Equal([]int{324, 232, 324, 232, 324, 232}, receiveSizes(all))
+	r.Equal([]int{324, 324}, receiveSizes(decimated))
+
+	// Cars sending at the same time are decimated separately, rather than
+	// every other packet being relayed.
+	alice := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 21), Port: 50000}
+	alicePacket, bobPacket := make([]byte, fh4PacketSize), make([]byte, fh4PacketSize)
+	alicePacket[0], bobPacket[0] = 'a', 'b'
+	for i := 0; i < 2; i++ {
+		forwarder.Forward(alicePacket, alice)
+		forwarder.Forward(bobPacket, bob)
+	}
+	var senders []byte
+	buf := make([]byte, 1024)
+	for {
+		decimated.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := decimated.Read(buf); err != nil {
+			break
+		}
+		senders = append(senders, buf[0])
+	}
+	r.Equal("ab", string(senders))
+
+	_, err = NewForwarder([]ForwardTarget{{Addr: all.LocalAddr().String(), Formats: []string{"gt7"}}})
+	r.Error(err)
+}
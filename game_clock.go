@@ -0,0 +1,80 @@
+package fh4server
+
+import (
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	useGameClock      = flag.Bool("use_game_clock", true, "when enabled, packets are timestamped using the game's timestamp_ms instead of the time they were received.")
+	gameClockMaxDrift = flag.Duration("game_clock_max_drift", time.Second, "the game clock is re-anchored to the wall clock when they drift apart by more than this, e.g. after the game is paused.")
+)
+
+// gameClock converts the game's timestamp_ms into wall clock times. The game
+// clock is anchored to the time a packet was received when a session starts,
+// and packets are then timestamped relative to the anchor so that the spacing
+// between them is not affected by network jitter or batching.
+//
+// timestamp_ms is a u32 which overflows every ~49.7 days. Rollovers are
+// detected and accounted for. Whenever the game clock drifts too far from the
+// wall clock (e.g. the game was paused, or restarted) it is re-anchored.
+type gameClock struct {
+	maxDrift time.Duration
+
+	anchored bool
+	// anchorWall is the wall clock time of the packet with game time
+	// anchorGame.
+	anchorWall time.Time
+	anchorGame uint64
+
+	// rollovers is the number of times timestamp_ms has overflowed.
+	rollovers uint64
+	lastRaw   uint32
+	raceOn    bool
+}
+
+func newGameClock(maxDrift time.Duration) *gameClock {
+	return &gameClock{maxDrift: maxDrift}
+}
+
+// timestamp returns the time of a packet with game time `raw` that was
+// received at `received`.
+func (clock *gameClock) timestamp(raw uint32, raceOn bool, received time.Time) time.Time {
+	const rolloverThreshold = 1 << 31
+	if clock.anchored && raw < clock.lastRaw && clock.lastRaw-raw > rolloverThreshold {
+		clock.rollovers++
+		glog.Infof("game clock rolled over")
+	}
+	game := clock.rollovers<<32 | uint64(raw)
+
+	sessionStarted := raceOn && !clock.raceOn
+	clock.lastRaw = raw
+	clock.raceOn = raceOn
+
+	if !clock.anchored || sessionStarted {
+		clock.anchor(game, received)
+		return received
+	}
+
+	// Packets from before the anchor (e.g. the game was restarted) are
+	// treated like any other drift.
+	var predicted time.Time
+	if game >= clock.anchorGame {
+		predicted = clock.anchorWall.Add(time.Duration(game-clock.anchorGame) * time.Millisecond)
+	}
+	drift := received.Sub(predicted)
+	if predicted.IsZero() || drift > clock.maxDrift || drift < -clock.maxDrift {
+		glog.V(1).Infof("re-anchoring game clock after drifting %v", drift)
+		clock.anchor(game, received)
+		return received
+	}
+	return predicted
+}
+
+func (clock *gameClock) anchor(game uint64, received time.Time) {
+	clock.anchored = true
+	clock.anchorGame = game
+	clock.anchorWall = received
+}
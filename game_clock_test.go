@@ -0,0 +1,36 @@
+package fh4server
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGameClock(t *testing.T) {
+	r := require.New(t)
+	clock := newGameClock(time.Second)
+	wall := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// The first packet anchors the clock.
+	r.Equal(wall, clock.timestamp(1000, true, wall))
+
+	// Jitter in the receive time does not affect the timestamp.
+	r.Equal(wall.Add(16*time.Millisecond), clock.timestamp(1016, true, wall.Add(40*time.Millisecond)))
+
+	// After a pause, the clock is re-anchored.
+	paused := wall.Add(time.Minute)
+	r.Equal(paused, clock.timestamp(1032, true, paused))
+	r.Equal(paused.Add(16*time.Millisecond), clock.timestamp(1048, true, paused.Add(20*time.Millisecond)))
+
+	// Starting a new session re-anchors the clock.
+	clock.timestamp(1064, false, paused.Add(30*time.Millisecond))
+	started := paused.Add(50 * time.Millisecond)
+	r.Equal(started, clock.timestamp(1080, true, started))
+
+	// Rollovers of timestamp_ms continue from where the clock left off.
+	clock = newGameClock(time.Second)
+	clock.timestamp(math.MaxUint32-10, true, wall)
+	r.Equal(wall.Add(21*time.Millisecond), clock.timestamp(10, true, wall.Add(25*time.Millisecond)))
+}
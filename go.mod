@@ -1,10 +1,15 @@
 module github.com/narrative/fh4server
 
-go 1.12
+go 1.16
 
 require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/google/go-cmp v0.3.0 // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/influxdata/influxdb-client-go v0.0.2-0.20190624212218-14e633ca65da
-	github.com/stretchr/testify v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/prometheus/client_golang v1.7.1
+	github.com/stretchr/testify v1.5.1
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	modernc.org/sqlite v1.14.8
 )
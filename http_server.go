@@ -0,0 +1,99 @@
+package fh4server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpListenAddr = flag.String("http_listen_addr", ":8080", "address to serve the live dashboard and stream on. The http server is disabled when empty.")
+)
+
+// HTTPServer serves fh4server's http endpoints:
+//
+//	/         the live dashboard
+//	/stream   the LiveStream WebSocket
+//	/metrics  prometheus metrics
+//	/healthz  200 if every liveness check passes, 503 otherwise
+//	/readyz   200 if every liveness and readiness check passes, 503 otherwise
+type HTTPServer struct {
+	server    *http.Server
+	listener  net.Listener
+	liveness  *healthChecks
+	readiness *healthChecks
+}
+
+// NewHTTPServerFromFlags starts an HTTPServer on -http_listen_addr. It returns
+// nil if the flag is empty.
+func NewHTTPServerFromFlags(stream *LiveStream) (*HTTPServer, error) {
+	if *httpListenAddr == "" {
+		return nil, nil
+	}
+	return NewHTTPServer(*httpListenAddr, stream)
+}
+
+// NewHTTPServer starts an HTTPServer listening on `addr`.
+func NewHTTPServer(addr string, stream *LiveStream) (*HTTPServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	httpServer := &HTTPServer{
+		listener:  listener,
+		liveness:  newHealthChecks(),
+		readiness: newHealthChecks(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveDashboard)
+	mux.Handle("/stream", stream)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, httpServer.liveness)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, httpServer.liveness, httpServer.readiness)
+	})
+	httpServer.server = &http.Server{Handler: mux}
+	go func() {
+		if err := httpServer.server.Serve(listener); err != http.ErrServerClosed {
+			glog.Errorf("http server stopped: %v", err)
+		}
+	}()
+	glog.Infof("serving http on %v", listener.Addr())
+	return httpServer, nil
+}
+
+// Addr returns the address the server is listening on.
+func (httpServer *HTTPServer) Addr() net.Addr {
+	return httpServer.listener.Addr()
+}
+
+// AddLivenessCheck adds a check to /healthz and /readyz, e.g. that the UDP
+// listener is open. A failing liveness check means fh4server should be
+// restarted.
+func (httpServer *HTTPServer) AddLivenessCheck(name string, checker HealthChecker) {
+	httpServer.liveness.add(name, checker)
+}
+
+// AddReadinessCheck adds a check to /readyz, e.g. that the db is accepting
+// writes. A failing readiness check means packets are not being stored, but
+// may be once a dependency recovers.
+func (httpServer *HTTPServer) AddReadinessCheck(name string, checker HealthChecker) {
+	httpServer.readiness.add(name, checker)
+}
+
+// Close stops the server, waiting a short while for requests in progress.
+// WebSocket connections are not waited for, they should be closed first by
+// closing the LiveStream.
+func (httpServer *HTTPServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return httpServer.server.Shutdown(ctx)
+}
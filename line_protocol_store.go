@@ -0,0 +1,339 @@
+package fh4server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	influxDatabase        = flag.String("influx_db", "fh4", "database packets are written to when -influx_protocol=v1.")
+	influxRetentionPolicy = flag.String("influx_retention_policy", "", "retention policy packets are written to when -influx_protocol=v1. The database's default is used when empty.")
+	influxUsername        = flag.String("influx_username", "", "username to authenticate with when -influx_protocol=v1.")
+	influxPassword        = flag.String("influx_password", "", "password to authenticate with when -influx_protocol=v1.")
+	influxPrecision       = flag.String("influx_precision", "ms", "precision of the timestamps written with line protocol, one of ns, us, ms or s.")
+	influxGzip            = flag.Bool("influx_gzip", true, "when enabled, line protocol writes are gzip compressed.")
+)
+
+// Precisions of the timestamps written by a LineProtocolStore, and how many
+// nanoseconds each is.
+var linePrecisions = map[string]int64{
+	"ns": 1,
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+}
+
+// v1Precisions are the names the InfluxDB v1 write API uses for each
+// precision.
+var v1Precisions = map[string]string{"ns": "n", "us": "u", "ms": "ms", "s": "s"}
+
+// LineProtocolOptions configures a LineProtocolStore.
+type LineProtocolOptions struct {
+	// Addr is the address of the InfluxDB server, e.g. http://localhost:8086.
+	Addr string
+	// Version is the write API to use, 1 for /write or 2 for /api/v2/write.
+	Version int
+	// Database and RetentionPolicy are written to with the v1 API. The
+	// database's default retention policy is used if RetentionPolicy is
+	// empty.
+	Database        string
+	RetentionPolicy string
+	// Username and Password authenticate with the v1 API.
+	Username string
+	Password string
+	// Org and Bucket are written to with the v2 API.
+	Org    string
+	Bucket string
+	// Token authenticates with the v2 API.
+	Token string
+	// Precision is the precision of timestamps, one of ns, us, ms or s.
+	Precision string
+	// Gzip compresses the body of each write.
+	Gzip bool
+	// Timeout limits how long each write can take.
+	Timeout time.Duration
+}
+
+// LineProtocolStore implements PacketStore and BatchPacketStore by writing
+// InfluxDB line protocol over http. It works with InfluxDB 1.x through the
+// /write API and with InfluxDB 2.x through the /api/v2/write API, without a
+// client library.
+type LineProtocolStore struct {
+	options  LineProtocolOptions
+	writeURL string
+	client   *http.Client
+
+	mu sync.Mutex
+	// lastErr is the error returned by the most recent write.
+	lastErr error
+}
+
+// NewLineProtocolStoreFromFlags sets up a LineProtocolStore from the -influx_*
+// flags, using the API version given by -influx_protocol.
+func NewLineProtocolStoreFromFlags() (*LineProtocolStore, error) {
+	options := LineProtocolOptions{
+		Addr:            *influxAddr,
+		Database:        *influxDatabase,
+		RetentionPolicy: *influxRetentionPolicy,
+		Username:        *influxUsername,
+		Password:        *influxPassword,
+		Org:             *orgName,
+		Bucket:          *bucketName,
+		Token:           *influxToken,
+		Precision:       *influxPrecision,
+		Gzip:            *influxGzip,
+		Timeout:         time.Duration(*timeout) * time.Second,
+	}
+	switch *influxProtocol {
+	case "v1":
+		options.Version = 1
+	case "v2":
+		options.Version = 2
+	default:
+		return nil, fmt.Errorf("-influx_protocol=%s does not use line protocol", *influxProtocol)
+	}
+	return NewLineProtocolStore(options)
+}
+
+// NewLineProtocolStore checks the options and returns a LineProtocolStore.
+// Nothing is sent to the server until the first write.
+func NewLineProtocolStore(options LineProtocolOptions) (*LineProtocolStore, error) {
+	if _, ok := linePrecisions[options.Precision]; !ok {
+		return nil, fmt.Errorf("unknown precision %q, expected one of ns, us, ms or s", options.Precision)
+	}
+	query := url.Values{}
+	var path string
+	switch options.Version {
+	case 1:
+		if options.Database == "" {
+			return nil, fmt.Errorf("a database is needed to write with the v1 API")
+		}
+		path = "/write"
+		query.Set("db", options.Database)
+		if options.RetentionPolicy != "" {
+			query.Set("rp", options.RetentionPolicy)
+		}
+		query.Set("precision", v1Precisions[options.Precision])
+	case 2:
+		if options.Org == "" || options.Bucket == "" {
+			return nil, fmt.Errorf("an org and bucket are needed to write with the v2 API")
+		}
+		path = "/api/v2/write"
+		query.Set("org", options.Org)
+		query.Set("bucket", options.Bucket)
+		query.Set("precision", options.Precision)
+	default:
+		return nil, fmt.Errorf("unknown InfluxDB API version %d", options.Version)
+	}
+	store := &LineProtocolStore{
+		options:  options,
+		writeURL: strings.TrimRight(options.Addr, "/") + path + "?" + query.Encode(),
+		client:   &http.Client{Timeout: options.Timeout},
+	}
+	glog.Infof("writing line protocol to %s", store.writeURL)
+	return store, nil
+}
+
+// WritePacket writes a packet to the database.
+func (store *LineProtocolStore) WritePacket(packet Packet) {
+	if err := store.WritePackets([]Packet{packet}); err != nil {
+		glog.Warningf("failed to write packet to db: %v", err)
+	}
+}
+
+// WritePackets writes a batch of packets to the database in a single request.
+func (store *LineProtocolStore) WritePackets(packets []Packet) error {
+	var body bytes.Buffer
+	var lines io.Writer = &body
+	var zipper *gzip.Writer
+	if store.options.Gzip {
+		zipper = gzip.NewWriter(&body)
+		lines = zipper
+	}
+	precision := linePrecisions[store.options.Precision]
+	for _, packet := range packets {
+		if err := writeLine(lines, packet, precision); err != nil {
+			return err
+		}
+	}
+	if zipper != nil {
+		if err := zipper.Close(); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := store.post(&body)
+	influxWriteDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		influxWriteErrors.Inc()
+	} else {
+		influxPointsWritten.Add(float64(len(packets)))
+	}
+	store.mu.Lock()
+	store.lastErr = err
+	store.mu.Unlock()
+	return err
+}
+
+func (store *LineProtocolStore) post(body io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), store.options.Timeout)
+	defer cancel()
+	request, err := http.NewRequest(http.MethodPost, store.writeURL, body)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if store.options.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case store.options.Version == 1 && store.options.Username != "":
+		request.SetBasicAuth(store.options.Username, store.options.Password)
+	case store.options.Version == 2 && store.options.Token != "":
+		request.Header.Set("Authorization", "Token "+store.options.Token)
+	}
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("write failed with %s: %s", response.Status, strings.TrimSpace(string(message)))
+}
+
+// Healthy returns the error of the most recent write, if it failed.
+func (store *LineProtocolStore) Healthy() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lastErr != nil {
+		return fmt.Errorf("last write failed: %v", store.lastErr)
+	}
+	return nil
+}
+
+// Close should be called when the store is no longer needed.
+func (store *LineProtocolStore) Close() error {
+	store.client.CloseIdleConnections()
+	return nil
+}
+
+// writeLine writes the packet as a line of line protocol, with its timestamp
+// in units of `precision` nanoseconds. Tags and fields are sorted by name.
+// Fields that can't be represented, like NaN, are left out, as are packets
+// with no fields.
+func writeLine(w io.Writer, packet Packet, precision int64) error {
+	measurement := packet.Measurement
+	if measurement == "" {
+		measurement = packetMeasurement
+	}
+	var line strings.Builder
+	line.WriteString(lineEscaper.Replace(measurement))
+
+	tags := make([]string, 0, len(packet.Tags))
+	for tag, value := range packet.Tags {
+		if value != "" {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		line.WriteString("," + keyEscaper.Replace(tag) + "=" + keyEscaper.Replace(packet.Tags[tag]))
+	}
+
+	labels := make([]string, 0, len(packet.Fields))
+	for label := range packet.Fields {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	separator := " "
+	for _, label := range labels {
+		value, ok := lineFieldValue(packet.Fields[label])
+		if !ok {
+			continue
+		}
+		line.WriteString(separator + keyEscaper.Replace(label) + "=" + value)
+		separator = ","
+	}
+	if separator == " " {
+		glog.V(1).Infof("not writing %s packet with no fields", measurement)
+		return nil
+	}
+
+	line.WriteString(" " + strconv.FormatInt(packet.Timestamp.UnixNano()/precision, 10) + "\n")
+	_, err := io.WriteString(w, line.String())
+	return err
+}
+
+var (
+	// lineEscaper escapes measurements.
+	lineEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	// keyEscaper escapes tag keys, tag values and field keys.
+	keyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	// stringEscaper escapes string field values.
+	stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// lineFieldValue formats a field value for line protocol. Integers are
+// written as signed integers, which both InfluxDB 1.x and 2.x accept.
+func lineFieldValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case bool:
+		return strconv.FormatBool(value), true
+	case string:
+		return `"` + stringEscaper.Replace(value) + `"`, true
+	case float32:
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(float64(value), 'g', -1, 32), true
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), true
+	case int:
+		return strconv.FormatInt(int64(value), 10) + "i", true
+	case int8:
+		return strconv.FormatInt(int64(value), 10) + "i", true
+	case int16:
+		return strconv.FormatInt(int64(value), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(value), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(value, 10) + "i", true
+	case uint8:
+		return strconv.FormatUint(uint64(value), 10) + "i", true
+	case uint16:
+		return strconv.FormatUint(uint64(value), 10) + "i", true
+	case uint32:
+		return strconv.FormatUint(uint64(value), 10) + "i", true
+	case uint64:
+		if value > math.MaxInt64 {
+			return "", false
+		}
+		return strconv.FormatUint(value, 10) + "i", true
+	}
+	return "", false
+}
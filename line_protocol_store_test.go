@@ -0,0 +1,160 @@
+package fh4server
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lineRequest is a write received by lineProtocolServer.
+type lineRequest struct {
+	request *http.Request
+	body    string
+}
+
+// lineProtocolServer is a stand in for InfluxDB, which records every write
+// and responds with `status` and `message`.
+func lineProtocolServer(r *require.Assertions, status int, message string) (*httptest.Server, chan lineRequest) {
+	requests := make(chan lineRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		var body io.Reader = request.Body
+		if request.Header.Get("Content-Encoding") == "gzip" {
+			zipped, err := gzip.NewReader(request.Body)
+			r.NoError(err)
+			body = zipped
+		}
+		lines, err := ioutil.ReadAll(body)
+		r.NoError(err)
+		requests <- lineRequest{request, string(lines)}
+		w.WriteHeader(status)
+		io.WriteString(w, message)
+	}))
+	return server, requests
+}
+
+func linePackets() []Packet {
+	return []Packet{
+		{
+			Measurement: packetMeasurement,
+			Fields:      map[string]interface{}{"speed": float32(23.5), "gear": uint8(3), "is_race_on": true},
+			Tags:        map[string]string{"car_id": "1234", driverTag: "alice smith"},
+			Timestamp:   time.Unix(1559390400, 123456789),
+		},
+		{
+			Measurement: lapMeasurement,
+			Fields:      map[string]interface{}{"lap_time": 60.5, "track": `say "hi"`},
+			Timestamp:   time.Unix(1559390460, 0),
+		},
+	}
+}
+
+func TestLineProtocolStoreV1(t *testing.T) {
+	r := require.New(t)
+	server, requests := lineProtocolServer(r, http.StatusNoContent, "")
+	defer server.Close()
+
+	store, err := NewLineProtocolStore(LineProtocolOptions{
+		Addr:            server.URL,
+		Version:         1,
+		Database:        "fh4",
+		RetentionPolicy: "week",
+		Username:        "fh4server",
+		Password:        "secret",
+		Precision:       "ms",
+		Gzip:            true,
+		Timeout:         time.Second,
+	})
+	r.NoError(err)
+	defer store.Close()
+	r.NoError(store.WritePackets(linePackets()))
+	r.NoError(store.Healthy())
+
+	received := <-requests
+	r.Equal("/write", received.request.URL.Path)
+	r.Equal("fh4", received.request.URL.Query().Get("db"))
+	r.Equal("week", received.request.URL.Query().Get("rp"))
+	r.Equal("ms", received.request.URL.Query().Get("precision"))
+	username, password, ok := received.request.BasicAuth()
+	r.True(ok)
+	r.Equal("fh4server", username)
+	r.Equal("secret", password)
+	r.Equal(
+		"fh4,car_id=1234,driver=alice\\ smith gear=3i,is_race_on=true,speed=23.5 1559390400123\n"+
+			"fh4_lap lap_time=60.5,track=\"say \\\"hi\\\"\" 1559390460000\n",
+		received.body)
+}
+
+func TestLineProtocolStoreV2(t *testing.T) {
+	r := require.New(t)
+	server, requests := lineProtocolServer(r, http.StatusNoContent, "")
+	defer server.Close()
+
+	store, err := NewLineProtocolStore(LineProtocolOptions{
+		Addr:      server.URL + "/",
+		Version:   2,
+		Org:       "fh4server",
+		Bucket:    "data",
+		Token:     "token",
+		Precision: "ns",
+		Timeout:   time.Second,
+	})
+	r.NoError(err)
+	defer store.Close()
+	store.WritePacket(linePackets()[0])
+
+	received := <-requests
+	r.Equal("/api/v2/write", received.request.URL.Path)
+	r.Equal("fh4server", received.request.URL.Query().Get("org"))
+	r.Equal("data", received.request.URL.Query().Get("bucket"))
+	r.Equal("ns", received.request.URL.Query().Get("precision"))
+	r.Equal("Token token", received.request.Header.Get("Authorization"))
+	r.Empty(received.request.Header.Get("Content-Encoding"))
+	r.Equal("fh4,car_id=1234,driver=alice\\ smith gear=3i,is_race_on=true,speed=23.5 1559390400123456789\n", received.body)
+}
+
+func TestLineProtocolStoreFailure(t *testing.T) {
+	r := require.New(t)
+	server, requests := lineProtocolServer(r, http.StatusBadRequest, `{"code":"invalid","message":"partial write"}`)
+	defer server.Close()
+
+	store, err := NewLineProtocolStore(LineProtocolOptions{Addr: server.URL, Version: 2, Org: "o", Bucket: "b", Precision: "s", Timeout: time.Second})
+	r.NoError(err)
+	err = store.WritePackets(linePackets())
+	r.Error(err)
+	r.Contains(err.Error(), "400 Bad Request")
+	r.Contains(err.Error(), "partial write")
+	r.Error(store.Healthy())
+	<-requests
+
+	_, err = NewLineProtocolStore(LineProtocolOptions{Addr: server.URL, Version: 1, Precision: "ms"})
+	r.Error(err)
+	_, err = NewLineProtocolStore(LineProtocolOptions{Addr: server.URL, Version: 2, Org: "o", Bucket: "b", Precision: "m"})
+	r.Error(err)
+}
+
+func TestWriteLine(t *testing.T) {
+	r := require.New(t)
+	var line strings.Builder
+	packet := Packet{
+		Measurement: "fh4",
+		Fields:      map[string]interface{}{"nan": math.NaN(), "a,b=c": int32(-5), "big": 1e21},
+		Tags:        map[string]string{"empty": "", "k=1": "v,1"},
+		Timestamp:   time.Unix(10, 0),
+	}
+	r.NoError(writeLine(&line, packet, int64(time.Second)))
+	r.Equal("fh4,k\\=1=v\\,1 a\\,b\\=c=-5i,big=1e+21 10\n", line.String())
+
+	// Packets with no fields that can be written are left out.
+	line.Reset()
+	packet.Fields = map[string]interface{}{"nan": math.NaN()}
+	r.NoError(writeLine(&line, packet, int64(time.Second)))
+	r.Empty(line.String())
+}
@@ -0,0 +1,271 @@
+package fh4server
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	streamEvery       = flag.Int("stream_every", 1, "only one in every n packets is sent to live stream clients, e.g. 3 to send 20 of the game's 60 packets per second. Clients can ask for fewer.")
+	streamClientQueue = flag.Int("stream_client_queue", 64, "number of packets queued for each live stream client. Packets are dropped for clients that fall further behind.")
+)
+
+// streamWriteTimeout limits how long a live stream client has to accept a
+// message before it is disconnected.
+const streamWriteTimeout = 5 * time.Second
+
+// LiveStream implements PacketStore by pushing each packet as JSON to every
+// client connected over a WebSocket. It is an http.Handler which accepts the
+// WebSocket connections.
+//
+// Clients choose which fields and tags they receive with the `fields` query
+// parameter, a comma separated list of labels, and can receive only one in
+// every n packets with the `every` parameter, e.g.
+// /stream?fields=speed,gear,current_engine_rpm&every=2. Either can be changed
+// later by sending a JSON message such as {"fields": ["speed"], "every": 4}.
+//
+// Packets are never written to a client directly from WritePacket, so a slow
+// client can't hold up the other clients or the rest of the pipeline. Packets
+// are dropped for a client whose queue is full.
+type LiveStream struct {
+	every      int
+	queueSize  int
+	upgrader   websocket.Upgrader
+	mu         sync.Mutex
+	clients    map[*streamClient]bool
+	packets    int
+	closed     bool
+	closedOnce sync.Once
+}
+
+// streamClient is a WebSocket connection to a LiveStream.
+type streamClient struct {
+	conn    *websocket.Conn
+	queue   chan Packet
+	dropped int
+	// done is closed when the client disconnects.
+	done chan struct{}
+
+	// mu guards the subscription, which is updated by the client's read
+	// loop.
+	mu        sync.Mutex
+	whitelist Whitelist
+	every     int
+	packets   int
+}
+
+// streamMessage is the JSON encoding of a Packet sent to clients.
+type streamMessage struct {
+	Format      string                 `json:"format"`
+	Measurement string                 `json:"measurement"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Fields      map[string]interface{} `json:"fields"`
+	Tags        map[string]string      `json:"tags"`
+}
+
+// streamSubscription is sent by clients to change what they receive.
+type streamSubscription struct {
+	Fields []string `json:"fields"`
+	Every  int      `json:"every"`
+}
+
+// NewLiveStreamFromFlags returns a LiveStream configured by the -stream_*
+// flags.
+func NewLiveStreamFromFlags() *LiveStream {
+	return NewLiveStream(*streamEvery, *streamClientQueue)
+}
+
+// NewLiveStream returns a LiveStream which sends one in every `every` packets
+// to clients, and queues up to `queueSize` packets for each client.
+func NewLiveStream(every, queueSize int) *LiveStream {
+	if every < 1 {
+		every = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &LiveStream{
+		every:     every,
+		queueSize: queueSize,
+		upgrader: websocket.Upgrader{
+			// The stream is read only, so any page may show it.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: make(map[*streamClient]bool),
+	}
+}
+
+// WritePacket queues the packet for every connected client.
+func (stream *LiveStream) WritePacket(packet Packet) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	// Summaries are always sent, decimation only applies to the packets
+	// from the game.
+	if packet.Measurement == packetMeasurement {
+		stream.packets++
+		if (stream.packets-1)%stream.every != 0 {
+			return
+		}
+	}
+	for client := range stream.clients {
+		client.send(packet)
+	}
+}
+
+// Clients returns the number of connected clients.
+func (stream *LiveStream) Clients() int {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return len(stream.clients)
+}
+
+// ServeHTTP upgrades the request to a WebSocket and streams packets to it
+// until the client disconnects.
+func (stream *LiveStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := &streamClient{whitelist: AllowAll(), every: 1}
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		client.whitelist = AllowList(strings.Split(fields, ","))
+	}
+	if every := r.URL.Query().Get("every"); every != "" {
+		n, err := strconv.Atoi(every)
+		if err != nil || n < 1 {
+			http.Error(w, "every must be a positive number", http.StatusBadRequest)
+			return
+		}
+		client.every = n
+	}
+	conn, err := stream.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client.
+		glog.V(1).Infof("failed to accept live stream client: %v", err)
+		return
+	}
+	client.conn = conn
+	client.queue = make(chan Packet, stream.queueSize)
+	client.done = make(chan struct{})
+
+	stream.mu.Lock()
+	if stream.closed {
+		stream.mu.Unlock()
+		conn.Close()
+		return
+	}
+	stream.clients[client] = true
+	stream.mu.Unlock()
+	glog.Infof("live stream client connected from %s", r.RemoteAddr)
+
+	go client.readSubscriptions()
+	client.writePackets()
+
+	stream.mu.Lock()
+	delete(stream.clients, client)
+	stream.mu.Unlock()
+	conn.Close()
+	glog.Infof("live stream client %s disconnected", r.RemoteAddr)
+}
+
+// Close disconnects every client.
+func (stream *LiveStream) Close() error {
+	stream.closedOnce.Do(func() {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		stream.closed = true
+		for client := range stream.clients {
+			close(client.queue)
+		}
+		stream.clients = make(map[*streamClient]bool)
+	})
+	return nil
+}
+
+// send queues a packet for the client if it is subscribed to it. Must be
+// called with the stream's lock held.
+func (client *streamClient) send(packet Packet) {
+	client.mu.Lock()
+	whitelist := client.whitelist
+	client.packets++
+	skip := packet.Measurement == packetMeasurement && (client.packets-1)%client.every != 0
+	client.mu.Unlock()
+	if skip {
+		return
+	}
+	select {
+	case client.queue <- packet.filter(whitelist):
+	default:
+		client.dropped++
+		if client.dropped%100 == 1 {
+			glog.Warningf("live stream client %v is falling behind, dropped %d packets", client.conn.RemoteAddr(), client.dropped)
+		}
+	}
+}
+
+// writePackets writes queued packets to the client until the queue is closed,
+// the client disconnects or a write fails.
+func (client *streamClient) writePackets() {
+	for {
+		select {
+		case packet, ok := <-client.queue:
+			if !ok {
+				client.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			client.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := client.conn.WriteJSON(newStreamMessage(packet)); err != nil {
+				glog.V(1).Infof("failed to write to live stream client: %v", err)
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// readSubscriptions updates the client's subscription from the messages it
+// sends, until the client disconnects.
+func (client *streamClient) readSubscriptions() {
+	defer close(client.done)
+	for {
+		var subscription streamSubscription
+		if err := client.conn.ReadJSON(&subscription); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				glog.V(1).Infof("failed to read from live stream client: %v", err)
+			}
+			return
+		}
+		client.mu.Lock()
+		if subscription.Fields != nil {
+			client.whitelist = AllowList(subscription.Fields)
+		}
+		if subscription.Every > 0 {
+			client.every = subscription.Every
+		}
+		client.mu.Unlock()
+	}
+}
+
+func newStreamMessage(packet Packet) streamMessage {
+	fields := make(map[string]interface{}, len(packet.Fields))
+	for label, value := range packet.Fields {
+		// JSON has no representation for NaN or infinity.
+		if v, ok := toFloat64(value); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			continue
+		}
+		fields[label] = value
+	}
+	return streamMessage{
+		Format:      packet.Format,
+		Measurement: packet.Measurement,
+		Timestamp:   packet.Timestamp,
+		Fields:      fields,
+		Tags:        packet.Tags,
+	}
+}
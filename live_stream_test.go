@@ -0,0 +1,131 @@
+package fh4server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func streamPacket(speed float32, gear uint8) Packet {
+	return Packet{
+		Format:      FormatFH4,
+		Measurement: packetMeasurement,
+		Fields:      map[string]interface{}{"speed": speed, "gear": gear},
+		Tags:        map[string]string{"car_id": "1234"},
+		Timestamp:   time.Unix(1559390400, 0),
+	}
+}
+
+// dialStream connects to the live stream and waits until the stream has
+// `clients` clients.
+func dialStream(r *require.Assertions, server *HTTPServer, stream *LiveStream, query string, clients int) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.Addr().String()+"/stream"+query, nil)
+	r.NoError(err)
+	for start := time.Now(); stream.Clients() < clients; time.Sleep(time.Millisecond) {
+		r.True(time.Since(start) < time.Second, "timed out waiting for client")
+	}
+	return conn
+}
+
+func readStreamMessage(r *require.Assertions, conn *websocket.Conn) streamMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var message streamMessage
+	r.NoError(conn.ReadJSON(&message))
+	return message
+}
+
+func TestLiveStream(t *testing.T) {
+	r := require.New(t)
+	stream := NewLiveStream(1, 16)
+	server, err := NewHTTPServer("127.0.0.1:0", stream)
+	r.NoError(err)
+	defer server.Close()
+
+	all := dialStream(r, server, stream, "", 1)
+	defer all.Close()
+	subscribed := dialStream(r, server, stream, "?fields=speed,car_id&every=2", 2)
+	defer subscribed.Close()
+
+	for i := 0; i < 4; i++ {
+		stream.WritePacket(streamPacket(float32(i), 3))
+	}
+	for i := 0; i < 4; i++ {
+		message := readStreamMessage(r, all)
+		r.Equal(map[string]interface{}{"speed": float64(i), "gear": float64(3)}, message.Fields)
+		r.Equal(packetMeasurement, message.Measurement)
+		r.True(time.Unix(1559390400, 0).Equal(message.Timestamp))
+	}
+	for _, speed := range []float64{0, 2} {
+		message := readStreamMessage(r, subscribed)
+		r.Equal(map[string]interface{}{"speed": speed}, message.Fields)
+		r.Equal(map[string]string{"car_id": "1234"}, message.Tags)
+	}
+
+	// Change the subscription, and wait for the change to take effect.
+	r.NoError(subscribed.WriteJSON(streamSubscription{Fields: []string{"gear"}, Every: 1}))
+	for {
+		// Two packets, so that one is sent while every is still 2.
+		stream.WritePacket(streamPacket(0, 4))
+		stream.WritePacket(streamPacket(0, 4))
+		if _, ok := readStreamMessage(r, subscribed).Fields["gear"]; ok {
+			break
+		}
+	}
+
+	stream.Close()
+	for {
+		subscribed.SetReadDeadline(time.Now().Add(time.Second))
+		var message streamMessage
+		err := subscribed.ReadJSON(&message)
+		if err != nil {
+			r.True(websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+			break
+		}
+	}
+}
+
+func TestLiveStreamDecimation(t *testing.T) {
+	r := require.New(t)
+	stream := NewLiveStream(3, 16)
+	server, err := NewHTTPServer("127.0.0.1:0", stream)
+	r.NoError(err)
+	defer server.Close()
+	defer stream.Close()
+	conn := dialStream(r, server, stream, "", 1)
+	defer conn.Close()
+
+	for i := 0; i < 6; i++ {
+		stream.WritePacket(streamPacket(float32(i), 3))
+	}
+	// Summaries are never decimated.
+	stream.WritePacket(Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5}})
+	r.Equal(float64(0), readStreamMessage(r, conn).Fields["speed"])
+	r.Equal(float64(3), readStreamMessage(r, conn).Fields["speed"])
+	r.Equal(lapMeasurement, readStreamMessage(r, conn).Measurement)
+}
+
+func TestHTTPServerServesDashboard(t *testing.T) {
+	r := require.New(t)
+	stream := NewLiveStream(1, 16)
+	server, err := NewHTTPServer("127.0.0.1:0", stream)
+	r.NoError(err)
+	defer server.Close()
+
+	response, err := http.Get("http://" + server.Addr().String() + "/")
+	r.NoError(err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	r.NoError(err)
+	r.Equal(http.StatusOK, response.StatusCode)
+	r.Contains(string(body), "/stream?fields=current_engine_rpm,")
+	r.NotContains(string(body), "{{fields}}")
+
+	response, err = http.Get("http://" + server.Addr().String() + "/missing")
+	r.NoError(err)
+	response.Body.Close()
+	r.Equal(http.StatusNotFound, response.StatusCode)
+}
@@ -0,0 +1,66 @@
+package fh4server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics are registered with the default prometheus registry, next to each
+// part of the pipeline they describe, and served in the prometheus text format
+// on /metrics by the HTTPServer. Go runtime metrics, such as the number of
+// goroutines, come from the default registry too.
+
+// HealthChecker is implemented by packet sources and stores that can tell
+// whether they are working. Healthy returns nil when they are.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// healthChecks are the checks served on /healthz or /readyz.
+type healthChecks struct {
+	mu     sync.Mutex
+	checks map[string]HealthChecker
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{checks: make(map[string]HealthChecker)}
+}
+
+func (health *healthChecks) add(name string, checker HealthChecker) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.checks[name] = checker
+}
+
+// failures returns a description of each failing check, sorted by name.
+func (health *healthChecks) failures() []string {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	var failed []string
+	for name, checker := range health.checks {
+		if err := checker.Healthy(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// serveHealth responds with 200 if every check in `checks` passes, and 503
+// with the failures otherwise.
+func serveHealth(w http.ResponseWriter, checks ...*healthChecks) {
+	var failed []string
+	for _, health := range checks {
+		failed = append(failed, health.failures()...)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failed, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
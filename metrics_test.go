@@ -0,0 +1,109 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHealth is a HealthChecker which returns err.
+type fakeHealth struct {
+	err error
+}
+
+func (health *fakeHealth) Healthy() error {
+	return health.err
+}
+
+func httpGet(r *require.Assertions, url string) (int, string) {
+	response, err := http.Get(url)
+	r.NoError(err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	r.NoError(err)
+	return response.StatusCode, string(body)
+}
+
+func TestHTTPServerHealth(t *testing.T) {
+	r := require.New(t)
+	server, err := NewHTTPServer("127.0.0.1:0", NewLiveStream(1, 16))
+	r.NoError(err)
+	defer server.Close()
+	url := "http://" + server.Addr().String()
+
+	udp, store := &fakeHealth{}, &fakeHealth{}
+	server.AddLivenessCheck("udp", udp)
+	server.AddReadinessCheck("store", store)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		status, body := httpGet(r, url+path)
+		r.Equal(http.StatusOK, status)
+		r.Equal("ok\n", body)
+	}
+
+	// A failing store makes the server unready, but not unhealthy.
+	store.err = errors.New("last write failed")
+	status, _ := httpGet(r, url+"/healthz")
+	r.Equal(http.StatusOK, status)
+	status, body := httpGet(r, url+"/readyz")
+	r.Equal(http.StatusServiceUnavailable, status)
+	r.Equal("store: last write failed\n", body)
+
+	udp.err = errors.New("udp listener closed")
+	status, body = httpGet(r, url+"/healthz")
+	r.Equal(http.StatusServiceUnavailable, status)
+	r.Equal("udp: udp listener closed\n", body)
+	_, body = httpGet(r, url+"/readyz")
+	// Liveness failures come first.
+	r.Equal("udp: udp listener closed\nstore: last write failed\n", body)
+}
+
+func TestMetrics(t *testing.T) {
+	r := require.New(t)
+	server, err := NewHTTPServer("127.0.0.1:0", NewLiveStream(1, 16))
+	r.NoError(err)
+	defer server.Close()
+
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	parsed := testutil.ToFloat64(packetsParsed.WithLabelValues(FormatFH4))
+	short := testutil.ToFloat64(parseErrors.WithLabelValues("short"))
+	_, err = ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	r.NoError(err)
+	_, err = ParseBuf(bytes.NewBuffer(packetBytes[:10]), AllowAll())
+	r.Error(err)
+	r.Equal(parsed+1, testutil.ToFloat64(packetsParsed.WithLabelValues(FormatFH4)))
+	r.Equal(short+1, testutil.ToFloat64(parseErrors.WithLabelValues("short")))
+
+	status, body := httpGet(r, "http://"+server.Addr().String()+"/metrics")
+	r.Equal(http.StatusOK, status)
+	r.Contains(body, `fh4server_packets_parsed_total{format="fh4"}`)
+	r.Contains(body, "go_goroutines")
+}
+
+func TestCompositeStoreMetrics(t *testing.T) {
+	r := require.New(t)
+	composite := NewCompositeStore()
+	composite.Add("all", newRecordingStore(), SinkOptions{})
+	composite.Add("unhealthy", &unhealthyStore{}, SinkOptions{})
+	composite.WritePacket(compositePacket(time.Unix(1559390400, 0), 1))
+	r.NoError(composite.Close())
+
+	r.Equal(6, testutil.CollectAndCount(composite))
+	r.EqualError(composite.Healthy(), "unhealthy: db unavailable")
+}
+
+// unhealthyStore is a PacketStore which is never healthy.
+type unhealthyStore struct{}
+
+func (store *unhealthyStore) WritePacket(packet Packet) {}
+
+func (store *unhealthyStore) Healthy() error {
+	return errors.New("db unavailable")
+}
@@ -3,60 +3,245 @@ package fh4server
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// Names of the packet formats understood by ParseBuf. The format is chosen
+// based on the length of the datagram.
+const (
+	// FormatFH4 is the 324 byte format sent by Forza Horizon 4.
+	FormatFH4 = "fh4"
+	// FormatFM7Sled is the 232 byte "sled" format sent by Forza Motorsport 7.
+	FormatFM7Sled = "fm7_sled"
+	// FormatFM7Dash is the 311 byte "car dash" format sent by Forza Motorsport 7.
+	FormatFM7Dash = "fm7_dash"
+)
+
+var (
+	// ErrShortPacket is returned by ParseBuf when a packet is smaller than
+	// every known packet format.
+	ErrShortPacket = errors.New("packet too short")
+	// ErrUnknownFormat is returned by ParseBuf when the size of a packet does
+	// not match any known packet format.
+	ErrUnknownFormat = errors.New("unknown packet format")
+)
+
+var (
+	packetsParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fh4server_packets_parsed_total",
+		Help: "Number of packets parsed by ParseBuf, by packet format.",
+	}, []string{"format"})
+	parseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fh4server_parse_errors_total",
+		Help: "Number of packets ParseBuf failed to parse, or parsed with trailing bytes, by reason: short, unknown_format, malformed or trailing_bytes.",
+	}, []string{"reason"})
+)
+
+// TrailingBytesError is returned by ParseBuf, along with a valid Packet, when a
+// packet is larger than every known packet format. The packet is parsed with
+// the largest format and the extra bytes are ignored, so this error can be
+// treated as a warning.
+type TrailingBytesError struct {
+	// Format is the name of the format the packet was parsed with.
+	Format string
+	// Count is the number of bytes that were ignored.
+	Count int
+}
+
+func (err *TrailingBytesError) Error() string {
+	return fmt.Sprintf("ignored %d trailing bytes after %s packet", err.Count, err.Format)
+}
+
 // Packet holds the parsed fields and tags from the raw message bytes.
 type Packet struct {
-	Fields map[string]interface{}
-	Tags   map[string]string
+	// Format is the name of the packet format that was used to parse the
+	// message, e.g. FormatFH4.
+	Format string
+	// Measurement is the name of the measurement the packet belongs to when
+	// stored, e.g. "fh4" for packets parsed from the game.
+	Measurement string
+	Fields      map[string]interface{}
+	Tags        map[string]string
+	// IsRaceOn is the value of the is_race_on element. It is set even when
+	// is_race_on is not in the whitelist.
+	IsRaceOn bool
+	// TimestampMs is the value of the packet's timestamp element, the game's
+	// clock in milliseconds.
+	TimestampMs uint32
+	// Timestamp is the time of the packet. ParseBuf leaves this unset, Run
+	// sets it from TimestampMs or the time the packet was received.
+	Timestamp time.Time
+
+	// hasTimestampMs is true when TimestampMs was parsed from the packet.
+	hasTimestampMs bool
 }
 
 // ParseBuf attempts to decode and parse the provided encoded packet buffer.
-func ParseBuf(buf *bytes.Buffer, whitelist Whitelist) Packet {
-	fields := make(map[string]interface{})
-	tags := make(map[string]string)
-	for _, element := range fh4PacketDefinition {
-		value := element.parse(buf)
-		if element.finisher != nil {
-			value = element.finisher(value)
+// The packet format is detected from the number of bytes in `buf`.
+//
+// ErrShortPacket or ErrUnknownFormat is returned if the packet can't be
+// parsed. A *TrailingBytesError is returned along with the parsed packet if
+// the packet was larger than expected.
+func ParseBuf(buf *bytes.Buffer, whitelist Whitelist) (Packet, error) {
+	packet, err := parseBuf(buf, whitelist)
+	_, trailingBytes := err.(*TrailingBytesError)
+	switch {
+	case errors.Is(err, ErrShortPacket):
+		parseErrors.WithLabelValues("short").Inc()
+	case errors.Is(err, ErrUnknownFormat):
+		parseErrors.WithLabelValues("unknown_format").Inc()
+	case trailingBytes:
+		parseErrors.WithLabelValues("trailing_bytes").Inc()
+	case err != nil:
+		parseErrors.WithLabelValues("malformed").Inc()
+	}
+	if packet.Format != "" {
+		packetsParsed.WithLabelValues(packet.Format).Inc()
+	}
+	return packet, err
+}
+
+func parseBuf(buf *bytes.Buffer, whitelist Whitelist) (Packet, error) {
+	format, warning := detectPacketFormat(buf.Len())
+	if format == nil {
+		return Packet{}, warning
+	}
+	packet := Packet{
+		Format:      format.name,
+		Measurement: packetMeasurement,
+		Fields:      make(map[string]interface{}),
+		Tags:        make(map[string]string),
+	}
+	if whitelist(formatTag) {
+		packet.Tags[formatTag] = format.name
+	}
+	for _, element := range format.elements {
+		raw, err := element.parse(buf)
+		if err != nil {
+			return Packet{}, fmt.Errorf("malformed %s packet: failed to parse %s: %v", format.name, element.label, err)
+		}
+		packet.addElement(element, raw, whitelist)
+	}
+	return packet, warning
+}
+
+// addElement finishes the raw value of an element and stores it, along with
+// any derived values, in the packet.
+func (packet *Packet) addElement(element *packetElement, raw interface{}, whitelist Whitelist) {
+	if raw == nil {
+		return
+	}
+	value := raw
+	if element.finisher != nil {
+		value = element.finisher(raw)
+	}
+	if element.label == raceOnLabel {
+		// The raw value is used, so that IsRaceOn doesn't depend on the
+		// element having the int_to_bool finisher.
+		raceOn, ok := toFloat64(raw)
+		packet.IsRaceOn = ok && raceOn != 0
+	}
+	if element.elementType == timestamp {
+		if timestampMs, ok := toFloat64(value); ok {
+			packet.TimestampMs = uint32(timestampMs)
+			packet.hasTimestampMs = true
+		}
+	}
+	packet.add(element.label, element.elementType, value, whitelist)
+	for _, derived := range element.derived {
+		packet.add(derived.label, element.elementType, derived.finisher(raw), whitelist)
+	}
+}
+
+// detectPacketFormat returns the packetFormat to use for packets of `size`
+// bytes. If there is no exact match, the largest format is used for packets
+// that are larger than every format and a *TrailingBytesError is returned.
+// Otherwise the format is nil and an error is returned.
+func detectPacketFormat(size int) (*packetFormat, error) {
+	if format := lookupPacketFormat(size); format != nil {
+		return format, nil
+	}
+	var smallest, largest *packetFormat
+	for _, format := range packetFormats {
+		if smallest == nil || format.size < smallest.size {
+			smallest = format
 		}
-		if value == nil {
-			continue
+		if largest == nil || format.size > largest.size {
+			largest = format
 		}
-		if !whitelist(element.label) {
-			continue
+	}
+	switch {
+	case largest == nil:
+		return nil, fmt.Errorf("%w (%d bytes): no packet formats registered", ErrUnknownFormat, size)
+	case size < smallest.size:
+		return nil, fmt.Errorf("%w (%d bytes, expected at least %d)", ErrShortPacket, size, smallest.size)
+	case size > largest.size:
+		return largest, &TrailingBytesError{Format: largest.name, Count: size - largest.size}
+	}
+	return nil, fmt.Errorf("%w (%d bytes)", ErrUnknownFormat, size)
+}
+
+// filter returns a copy of the packet with only the whitelisted fields and
+// tags.
+func (packet Packet) filter(whitelist Whitelist) Packet {
+	filtered := packet
+	filtered.Fields = make(map[string]interface{}, len(packet.Fields))
+	filtered.Tags = make(map[string]string, len(packet.Tags))
+	for label, value := range packet.Fields {
+		if whitelist(label) {
+			filtered.Fields[label] = value
 		}
-		switch element.elementType {
-		case field:
-			fields[element.label] = value
-			break
-		case tag:
-			tags[element.label] = fmt.Sprint(value)
-			break
-		case timestamp:
-			break
-		case none:
-			break
-		default:
-			glog.Infof("unexpected elementType encountered: %v", element.elementType)
+	}
+	for label, value := range packet.Tags {
+		if whitelist(label) {
+			filtered.Tags[label] = value
 		}
 	}
-	return Packet{Fields: fields, Tags: tags}
+	return filtered
+}
+
+// add stores a parsed value in the packet's fields or tags, according to
+// `elementType`.
+func (packet *Packet) add(label string, elementType byte, value interface{}, whitelist Whitelist) {
+	if value == nil {
+		return
+	}
+	if !whitelist(label) {
+		return
+	}
+	switch elementType {
+	case field:
+		packet.Fields[label] = value
+		break
+	case tag:
+		packet.Tags[label] = fmt.Sprint(value)
+		break
+	case timestamp:
+		break
+	case none:
+		break
+	default:
+		glog.Infof("unexpected elementType encountered: %v", elementType)
+	}
 }
 
 // Parse attempts to decode and parse the provided encoded packet.
 // Deprecated. Use ParseBuf instead.
 func Parse(packet []byte, whitelist func(string) bool) Packet {
-	// TODO: move this validation to the FH4Game packet source.
-	const packetSize = 324
-	if len(packet) != packetSize {
-		glog.Errorf("unexpected packet size (expected %d, got %d)", packetSize, len(packet))
-	}
 	buf := bytes.NewBuffer(packet)
-	return ParseBuf(buf, whitelist)
+	parsed, err := ParseBuf(buf, whitelist)
+	if err != nil {
+		glog.Errorf("failed to parse packet: %v", err)
+	}
+	return parsed
 }
 
 const (
@@ -70,7 +255,16 @@ const (
 // and return a key/value pair, the type of influx data (field vs tag) it is, or an error.
 type packetElement struct {
 	label string
-	parse func(*bytes.Buffer) interface{}
+	// dataType is the name of the binary type of the element, e.g. "f32".
+	dataType string
+	// size is the number of bytes consumed by parse.
+	size int
+	// parse consumes the element from the buffer and returns its value, or
+	// nil if the element has no value.
+	parse func(*bytes.Buffer) (interface{}, error)
+	// encode is the inverse of parse. It writes `size` bytes holding the
+	// value to the buffer. A nil value is written as zero.
+	encode func(*bytes.Buffer, interface{}) error
 
 	// elementType holds whether this packetElement is a field or a tag in influx.
 	// Note that by default, packets are specified as none, meaning they will
@@ -78,8 +272,21 @@ type packetElement struct {
 	// Also, a packetElement can not be both a field and a tag.
 	elementType byte
 
-	// unimplemented
-	finisher func(interface{}) interface{}
+	// finisher, if set, converts the parsed value before it is stored.
+	finisher     finisher
+	finisherName string
+
+	// derived holds additional values which are computed from the parsed
+	// value, e.g. a speed in km/h from a speed in m/s. They are stored with
+	// the same elementType as the element itself.
+	derived []derivedElement
+}
+
+// derivedElement is an extra value computed from a packetElement.
+type derivedElement struct {
+	label        string
+	finisher     finisher
+	finisherName string
 }
 
 func (p *packetElement) withLabel(label string) *packetElement {
@@ -87,6 +294,24 @@ func (p *packetElement) withLabel(label string) *packetElement {
 	return p
 }
 
+// withFinisher converts the parsed value with the named finisher.
+func (p *packetElement) withFinisher(name string) *packetElement {
+	p.finisher = mustLookupFinisher(name)
+	p.finisherName = name
+	return p
+}
+
+// derive adds a value labelled `label`, computed from the raw parsed value
+// with the named finisher.
+func (p *packetElement) derive(label string, finisherName string) *packetElement {
+	p.derived = append(p.derived, derivedElement{
+		label:        label,
+		finisher:     mustLookupFinisher(finisherName),
+		finisherName: finisherName,
+	})
+	return p
+}
+
 func (p *packetElement) field() *packetElement {
 	p.elementType = field
 	return p
@@ -103,84 +328,227 @@ func (p *packetElement) timestamp() *packetElement {
 }
 
 func s8() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed int8
-		binary.Read(bytes.NewBuffer(buf.Next(1)), binary.LittleEndian, &parsed)
-		return parsed
+	return &packetElement{dataType: "s8", size: 1, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(1)
+		if len(b) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return int8(b[0]), nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeInt(value, math.MinInt8, math.MaxInt8)
+		buf.WriteByte(byte(int8(v)))
+		return err
 	}}
 }
 
 func s32() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed int32
-		binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &parsed)
-		return parsed
+	return &packetElement{dataType: "s32", size: 4, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(4)
+		if len(b) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return int32(binary.LittleEndian.Uint32(b)), nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeInt(value, math.MinInt32, math.MaxInt32)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(int32(v)))
+		buf.Write(b[:])
+		return err
 	}}
 }
 
 func u8() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed uint8
-		binary.Read(bytes.NewBuffer(buf.Next(1)), binary.LittleEndian, &parsed)
-		return parsed
+	return &packetElement{dataType: "u8", size: 1, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(1)
+		if len(b) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b[0], nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeInt(value, 0, math.MaxUint8)
+		buf.WriteByte(byte(v))
+		return err
 	}}
 }
 
 func u16() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed uint16
-		binary.Read(bytes.NewBuffer(buf.Next(2)), binary.LittleEndian, &parsed)
-		return parsed
+	return &packetElement{dataType: "u16", size: 2, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(2)
+		if len(b) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return binary.LittleEndian.Uint16(b), nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeInt(value, 0, math.MaxUint16)
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(v))
+		buf.Write(b[:])
+		return err
 	}}
 }
 
 func u32() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed uint32
-		binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &parsed)
-		return parsed
+	return &packetElement{dataType: "u32", size: 4, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(4)
+		if len(b) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return binary.LittleEndian.Uint32(b), nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeInt(value, 0, math.MaxUint32)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		buf.Write(b[:])
+		return err
 	}}
 }
 
 func f32() *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		var parsed float32
-		binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &parsed)
-		return parsed
-		/*bits := binary.LittleEndian.Uint32(buf.Next(4))
-		float := math.Float32frombits(bits)
-		return float*/
+	return &packetElement{dataType: "f32", size: 4, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		b := buf.Next(4)
+		if len(b) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		v, err := encodeFloat(value)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(v))
+		buf.Write(b[:])
+		return err
 	}}
 }
 
+// skipType is the dataType of elements created by skipBytes.
+const skipType = "skip"
+
+// skipBytes consumes bytes that are not understood. They are encoded as
+// zeros.
 func skipBytes(count int) *packetElement {
-	return &packetElement{parse: func(buf *bytes.Buffer) interface{} {
-		buf.Next(count)
+	return &packetElement{dataType: skipType, size: count, parse: func(buf *bytes.Buffer) (interface{}, error) {
+		if len(buf.Next(count)) < count {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil
+	}, encode: func(buf *bytes.Buffer, value interface{}) error {
+		buf.Write(make([]byte, count))
 		return nil
 	}}
 }
 
-// TODO: put this crap into a configuration file instead.
+// raceOnLabel is the label of the element used to set Packet.IsRaceOn.
+const raceOnLabel = "is_race_on"
+
+// formatTag is the tag used to record which packet format a packet was
+// parsed with.
+const formatTag = "packet_format"
+
+// packetFormat is a named list of packetElements that make up one of the
+// datagram layouts sent by the game.
+type packetFormat struct {
+	name     string
+	elements []*packetElement
+	// size is the total number of bytes in a packet of this format.
+	size int
+	// builtIn is true for the built in formats, until they are replaced by a
+	// packet definition file. Packets of these formats can be decoded into a
+	// TelemetryFrame.
+	builtIn bool
+}
+
+// packetFormats holds every known packetFormat, keyed by name.
+var packetFormats = make(map[string]*packetFormat)
+
+// registerPacketFormat adds a packet format to the set of formats considered
+// by ParseBuf. Formats are identified by their size, so a format replaces any
+// previously registered format of the same name or size.
+func registerPacketFormat(name string, elements []*packetElement) *packetFormat {
+	format := &packetFormat{name: name, elements: elements}
+	for _, element := range elements {
+		format.size += element.size
+	}
+	for existingName, existing := range packetFormats {
+		if existing.size == format.size {
+			delete(packetFormats, existingName)
+		}
+	}
+	packetFormats[name] = format
+	return format
+}
+
+// lookupPacketFormat returns the packetFormat for packets of `size` bytes, or
+// nil if there is no such format.
+func lookupPacketFormat(size int) *packetFormat {
+	for _, format := range packetFormats {
+		if format.size == size {
+			return format
+		}
+	}
+	return nil
+}
+
+func concatElements(lists ...[]*packetElement) []*packetElement {
+	var elements []*packetElement
+	for _, list := range lists {
+		elements = append(elements, list...)
+	}
+	return elements
+}
+
+// builtInPacketDefinitions holds the packet definitions that are compiled in,
+// keyed by format name.
+var builtInPacketDefinitions = map[string][]*packetElement{
+	FormatFM7Sled: sledPacketDefinition,
+	FormatFM7Dash: fm7DashPacketDefinition,
+	FormatFH4:     fh4PacketDefinition,
+}
+
+func init() {
+	for name, elements := range builtInPacketDefinitions {
+		registerPacketFormat(name, elements).builtIn = true
+	}
+}
+
+// The built in packet definitions below can be replaced at runtime with a
+// packet definition file, see LoadPacketDefinition.
 var (
 	// fh4PacketDefinition contains a list of every field in the message we
 	// receive from FH4. The order the fields appear in this list is the order
 	// in which they exist in the packet.
 	//
 	// Packet bytes layout
-	// [0]-[231]
+	// [0]-[231] FM7 Sled data
 	// [232]-[243] FH4 new unknown data
 	// [244]-[322] FM7 Car Dash data
 	// [323] FH4 new unknown data
 	//
 	// source: https://forums.forzamotorsport.net/turn10_postsm926839_Forza-Motorsport-7--Data-Out--feature-details.aspx
-	fh4PacketDefinition = []*packetElement{
+	fh4PacketDefinition = concatElements(
+		sledPacketDefinition,
+		// Apparently, FH4 has some unknown bytes here that need to be
+		// skipped before we get to the dashboard properties.
+		[]*packetElement{skipBytes(12)},
+		dashPacketDefinition,
+		[]*packetElement{skipBytes(1)},
+	)
+
+	// fm7DashPacketDefinition is the FM7 "car dash" format, which is the sled
+	// format immediately followed by the dash properties.
+	fm7DashPacketDefinition = concatElements(
+		sledPacketDefinition,
+		dashPacketDefinition,
+	)
+
+	// sledPacketDefinition is the FM7 "sled" format. It is also the first
+	// part of the FM7 dash and FH4 formats.
+	sledPacketDefinition = []*packetElement{
 
 		//
 		// Start of "sled" format
 		//
 
 		// = 1 when race is on. = 0 when in menus/race stopped …
-		s32().tag().withLabel("is_race_on"),
+		s32().tag().withLabel("is_race_on").withFinisher("int_to_bool"),
 		// Can overflow to 0 eventually
 		u32().timestamp().withLabel("timestamp_ms"),
 		f32().field().withLabel("engine_max_rpm"),
@@ -219,16 +587,20 @@ var (
 		f32().field().withLabel("tire_slip_ratio_rear_right"),
 
 		// Wheel rotation speed radians/sec.
-		f32().field().withLabel("wheel_rotation_speed_front_left"),
-		f32().field().withLabel("wheel_rotation_speed_front_right"),
-		f32().field().withLabel("wheel_rotation_speed_rear_left"),
-		f32().field().withLabel("wheel_rotation_speed_rear_right"),
+		f32().field().withLabel("wheel_rotation_speed_front_left").
+			derive("wheel_rotation_speed_front_left_rpm", "rad_per_sec_to_rpm"),
+		f32().field().withLabel("wheel_rotation_speed_front_right").
+			derive("wheel_rotation_speed_front_right_rpm", "rad_per_sec_to_rpm"),
+		f32().field().withLabel("wheel_rotation_speed_rear_left").
+			derive("wheel_rotation_speed_rear_left_rpm", "rad_per_sec_to_rpm"),
+		f32().field().withLabel("wheel_rotation_speed_rear_right").
+			derive("wheel_rotation_speed_rear_right_rpm", "rad_per_sec_to_rpm"),
 
 		// = 1 when wheel is on rumble strip, = 0 when off.
-		s32().field().withLabel("on_rumble_strip_front_left"),
-		s32().field().withLabel("on_rumble_strip_front_right"),
-		s32().field().withLabel("on_rumble_strip_rear_left"),
-		s32().field().withLabel("on_rumble_strip_rear_right"),
+		s32().field().withLabel("on_rumble_strip_front_left").withFinisher("int_to_bool"),
+		s32().field().withLabel("on_rumble_strip_front_right").withFinisher("int_to_bool"),
+		s32().field().withLabel("on_rumble_strip_rear_left").withFinisher("int_to_bool"),
+		s32().field().withLabel("on_rumble_strip_rear_right").withFinisher("int_to_bool"),
 
 		// = from 0 to 1, where 1 is the deepest puddle
 		f32().field().withLabel("puddle_depth_front_left"),
@@ -269,10 +641,11 @@ var (
 		//
 		// End of "sled" format
 		//
+	}
 
-		// Apparently, FH4 has some unknown bytes here that need to be
-		// skipped before we get to the dashboard properties.
-		skipBytes(12),
+	// dashPacketDefinition holds the properties that the "dash" format adds
+	// on to the end of the sled format.
+	dashPacketDefinition = []*packetElement{
 
 		//
 		// Start of "Dash" format
@@ -282,14 +655,24 @@ var (
 		f32().field().withLabel("position_y"),
 		f32().field().withLabel("position_z"),
 
-		f32().field().withLabel("speed"),  // in meters per second
-		f32().field().withLabel("power"),  // in watts
+		// in meters per second
+		f32().field().withLabel("speed").
+			derive("speed_kph", "mps_to_kph").
+			derive("speed_mph", "mps_to_mph"),
+		// in watts
+		f32().field().withLabel("power").
+			derive("power_hp", "watts_to_hp"),
 		f32().field().withLabel("torque"), // in newton meters
 
-		f32().field().withLabel("tire_temp_front_right"),
-		f32().field().withLabel("tire_temp_front_left"),
-		f32().field().withLabel("tire_temp_rear_left"),
-		f32().field().withLabel("tire_temp_rear_right"),
+		// in degrees fahrenheit
+		f32().field().withLabel("tire_temp_front_right").
+			derive("tire_temp_front_right_celsius", "fahrenheit_to_celsius"),
+		f32().field().withLabel("tire_temp_front_left").
+			derive("tire_temp_front_left_celsius", "fahrenheit_to_celsius"),
+		f32().field().withLabel("tire_temp_rear_left").
+			derive("tire_temp_rear_left_celsius", "fahrenheit_to_celsius"),
+		f32().field().withLabel("tire_temp_rear_right").
+			derive("tire_temp_rear_right_celsius", "fahrenheit_to_celsius"),
 
 		f32().field().withLabel("boost"),
 		f32().field().withLabel("fuel"),
@@ -0,0 +1,188 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// packetColumn is a column of a table of packets, used by the stores which
+// write packets to a fixed schema.
+type packetColumn struct {
+	name string
+	// kind is the kind of the column's values. Tags are always strings.
+	kind reflect.Kind
+	// tag is true for tags.
+	tag bool
+}
+
+// runtimeTags are the tags added to packets by Run and the session tracker,
+// rather than parsed from the packet.
+var runtimeTags = []string{formatTag, sessionTag, sourceTag, driverTag}
+
+// packetColumns returns a column for every field and tag of every registered
+// packet format, plus the tags added by Run. Columns are sorted by name, tags
+// first, so the order is stable as long as the packet definition is.
+func packetColumns() []packetColumn {
+	sorted := definitionColumns()
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].tag != sorted[j].tag {
+			return sorted[i].tag
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	return sorted
+}
+
+// definitionColumns returns the columns of packetColumns in packet definition
+// order: the elements of each format in order, each followed by its derived
+// values, then the tags added by Run. Formats are taken in name order, and a
+// label in several formats keeps its first position.
+//
+// The kind of each field's column is found by parsing a packet of zeroes, so
+// that finishers and derived values are accounted for.
+func definitionColumns() []packetColumn {
+	var columns []packetColumn
+	positions := make(map[string]int)
+	add := func(column packetColumn) {
+		if i, ok := positions[column.name]; ok {
+			if existing := columns[i]; existing != column {
+				glog.Warningf("%s is a %v and a %v in different packet formats, using %v", column.name, existing.kind, column.kind, existing.kind)
+			}
+			return
+		}
+		positions[column.name] = len(columns)
+		columns = append(columns, column)
+	}
+	for _, format := range sortedPacketFormats() {
+		for _, element := range format.elements {
+			if element.elementType != field && element.elementType != tag {
+				continue
+			}
+			raw, err := element.parse(bytes.NewBuffer(make([]byte, element.size)))
+			if err != nil || raw == nil {
+				continue
+			}
+			labels := []string{element.label}
+			values := []interface{}{raw}
+			if element.finisher != nil {
+				values[0] = element.finisher(raw)
+			}
+			for _, derived := range element.derived {
+				labels = append(labels, derived.label)
+				values = append(values, derived.finisher(raw))
+			}
+			for i, label := range labels {
+				if element.elementType == tag {
+					add(packetColumn{name: label, kind: reflect.String, tag: true})
+				} else if values[i] != nil {
+					add(packetColumn{name: label, kind: reflect.TypeOf(values[i]).Kind()})
+				}
+			}
+		}
+	}
+	for _, tag := range runtimeTags {
+		add(packetColumn{name: tag, kind: reflect.String, tag: true})
+	}
+	return columns
+}
+
+// sortedPacketFormats returns the registered packet formats, sorted by name.
+func sortedPacketFormats() []*packetFormat {
+	formats := make([]*packetFormat, 0, len(packetFormats))
+	for _, format := range packetFormats {
+		formats = append(formats, format)
+	}
+	sort.Slice(formats, func(i, j int) bool { return formats[i].name < formats[j].name })
+	return formats
+}
+
+// finiteColumnValues returns the packet's value for each column, or nil where
+// the packet has no value. The fields and tags which have no column are returned
+// as a JSON object, {"fields": {...}, "tags": {...}}, or nil if there are none.
+// NaN and infinite values, which JSON and some databases can't represent, are
+// returned as nil and left out of the JSON object.
+func finiteColumnValues(packet Packet, columns []packetColumn) ([]interface{}, interface{}) {
+	values := make([]interface{}, 0, len(columns))
+	used := make(map[string]bool)
+	for _, column := range columns {
+		var value interface{}
+		if column.tag {
+			if tagValue, ok := packet.Tags[column.name]; ok {
+				value = tagValue
+			}
+		} else {
+			value = packet.Fields[column.name]
+			if !isFinite(value) {
+				used[column.name] = true
+				value = nil
+			}
+		}
+		if value != nil {
+			used[column.name] = true
+		}
+		values = append(values, value)
+	}
+
+	extra := make(map[string]map[string]interface{})
+	for label, value := range packet.Fields {
+		if !used[label] && isFinite(value) {
+			if extra["fields"] == nil {
+				extra["fields"] = make(map[string]interface{})
+			}
+			extra["fields"][label] = value
+		}
+	}
+	for label, value := range packet.Tags {
+		if !used[label] {
+			if extra["tags"] == nil {
+				extra["tags"] = make(map[string]interface{})
+			}
+			extra["tags"][label] = value
+		}
+	}
+	if len(extra) == 0 {
+		return values, nil
+	}
+	encoded, err := json.Marshal(extra)
+	if err != nil {
+		// One bad value shouldn't fail a whole batch, so only it is lost.
+		glog.Warningf("failed to encode extra values, leaving them out: %v", err)
+		return values, nil
+	}
+	return values, string(encoded)
+}
+
+// finiteFields returns the fields without NaN and infinite values, or fields
+// itself if it has none.
+func finiteFields(fields map[string]interface{}) map[string]interface{} {
+	for _, value := range fields {
+		if isFinite(value) {
+			continue
+		}
+		finite := make(map[string]interface{}, len(fields))
+		for label, value := range fields {
+			if isFinite(value) {
+				finite[label] = value
+			}
+		}
+		return finite
+	}
+	return fields
+}
+
+// isFinite returns false for NaN and infinite floats, and true for any other
+// value.
+func isFinite(value interface{}) bool {
+	switch value := value.(type) {
+	case float32:
+		return !math.IsNaN(float64(value)) && !math.IsInf(float64(value), 0)
+	case float64:
+		return !math.IsNaN(value) && !math.IsInf(value, 0)
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package fh4server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+var (
+	packetDefinitionPath = flag.String("packet_definition", "", "path to a JSON packet definition file. Formats in the file replace the built in formats with the same name or size.")
+)
+
+// packetDefinitionFile is the schema of a packet definition file. For
+// example:
+//
+//	{
+//	  "formats": [
+//	    {
+//	      "name": "fm7_sled",
+//	      "size": 232,
+//	      "elements": [
+//	        {"type": "s32", "label": "is_race_on", "kind": "tag"},
+//	        {"type": "u32", "label": "timestamp_ms", "kind": "timestamp"},
+//	        {"type": "skip", "size": 12},
+//	        ...
+//	      ]
+//	    }
+//	  ]
+//	}
+type packetDefinitionFile struct {
+	Formats []packetFormatDefinition `json:"formats"`
+}
+
+type packetFormatDefinition struct {
+	Name string `json:"name"`
+	// Size is the expected length of the packet in bytes. The sizes of the
+	// elements must add up to this.
+	Size     int                       `json:"size"`
+	Elements []packetElementDefinition `json:"elements"`
+}
+
+type packetElementDefinition struct {
+	// Type is one of s8, s32, u8, u16, u32, f32 or skip.
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+	// Kind is one of field, tag, timestamp or none. Defaults to none.
+	Kind string `json:"kind,omitempty"`
+	// Size is the number of bytes to skip. Only used by the skip type.
+	Size int `json:"size,omitempty"`
+	// Finisher is the name of a finisher used to convert the value, e.g.
+	// int_to_bool.
+	Finisher string `json:"finisher,omitempty"`
+	// Derived lists additional values computed from this element.
+	Derived []derivedElementDefinition `json:"derived,omitempty"`
+}
+
+type derivedElementDefinition struct {
+	Label    string `json:"label"`
+	Finisher string `json:"finisher"`
+}
+
+var (
+	elementConstructors = map[string]func() *packetElement{
+		"s8":  s8,
+		"s32": s32,
+		"u8":  u8,
+		"u16": u16,
+		"u32": u32,
+		"f32": f32,
+	}
+
+	elementKinds = map[string]byte{
+		"":          none,
+		"none":      none,
+		"timestamp": timestamp,
+		"field":     field,
+		"tag":       tag,
+	}
+)
+
+// LoadPacketDefinition registers the packet formats from the file given by the
+// -packet_definition flag. It does nothing if the flag is not set.
+func LoadPacketDefinition() error {
+	if *packetDefinitionPath == "" {
+		return nil
+	}
+	file, err := os.Open(*packetDefinitionPath)
+	if err != nil {
+		return fmt.Errorf("failed to open packet definition: %v", err)
+	}
+	defer file.Close()
+
+	formats, err := readPacketDefinition(file)
+	if err != nil {
+		return fmt.Errorf("invalid packet definition %s: %v", *packetDefinitionPath, err)
+	}
+	for _, format := range formats {
+		registerPacketFormat(format.Name, format.elements)
+		glog.Infof("loaded packet format %s (%d bytes) from %s", format.Name, format.Size, *packetDefinitionPath)
+	}
+	return nil
+}
+
+// loadedPacketFormat is a validated packetFormatDefinition.
+type loadedPacketFormat struct {
+	packetFormatDefinition
+	elements []*packetElement
+}
+
+// readPacketDefinition decodes and validates a packet definition file.
+func readPacketDefinition(r io.Reader) ([]loadedPacketFormat, error) {
+	var definition packetDefinitionFile
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, err
+	}
+	if len(definition.Formats) == 0 {
+		return nil, fmt.Errorf("no formats defined")
+	}
+
+	formats := make([]loadedPacketFormat, 0, len(definition.Formats))
+	sizes := make(map[int]string)
+	for _, formatDefinition := range definition.Formats {
+		if formatDefinition.Name == "" {
+			return nil, fmt.Errorf("format is missing a name")
+		}
+		if other, ok := sizes[formatDefinition.Size]; ok {
+			return nil, fmt.Errorf("formats %s and %s have the same size", other, formatDefinition.Name)
+		}
+		sizes[formatDefinition.Size] = formatDefinition.Name
+
+		elements, err := buildElements(formatDefinition)
+		if err != nil {
+			return nil, fmt.Errorf("format %s: %v", formatDefinition.Name, err)
+		}
+		formats = append(formats, loadedPacketFormat{formatDefinition, elements})
+	}
+	return formats, nil
+}
+
+func buildElements(formatDefinition packetFormatDefinition) ([]*packetElement, error) {
+	elements := make([]*packetElement, 0, len(formatDefinition.Elements))
+	labels := make(map[string]struct{})
+	offset := 0
+	for _, elementDefinition := range formatDefinition.Elements {
+		var element *packetElement
+		if elementDefinition.Type == skipType {
+			if elementDefinition.Size <= 0 {
+				return nil, fmt.Errorf("skip at offset %d must have a positive size", offset)
+			}
+			element = skipBytes(elementDefinition.Size)
+		} else {
+			constructor, ok := elementConstructors[elementDefinition.Type]
+			if !ok {
+				return nil, fmt.Errorf("unknown type %q at offset %d", elementDefinition.Type, offset)
+			}
+			if elementDefinition.Label == "" {
+				return nil, fmt.Errorf("%s at offset %d is missing a label", elementDefinition.Type, offset)
+			}
+			if _, ok := labels[elementDefinition.Label]; ok {
+				return nil, fmt.Errorf("duplicate label %q at offset %d", elementDefinition.Label, offset)
+			}
+			labels[elementDefinition.Label] = struct{}{}
+
+			kind, ok := elementKinds[elementDefinition.Kind]
+			if !ok {
+				return nil, fmt.Errorf("unknown kind %q for %s", elementDefinition.Kind, elementDefinition.Label)
+			}
+			element = constructor().withLabel(elementDefinition.Label)
+			element.elementType = kind
+			if err := addFinishers(element, elementDefinition, labels); err != nil {
+				return nil, err
+			}
+		}
+		elements = append(elements, element)
+		offset += element.size
+	}
+	if offset != formatDefinition.Size {
+		return nil, fmt.Errorf("elements add up to %d bytes, expected %d", offset, formatDefinition.Size)
+	}
+	return elements, nil
+}
+
+func addFinishers(element *packetElement, elementDefinition packetElementDefinition, labels map[string]struct{}) error {
+	if elementDefinition.Finisher != "" {
+		f, err := lookupFinisher(elementDefinition.Finisher)
+		if err != nil {
+			return fmt.Errorf("%s: %v", element.label, err)
+		}
+		element.finisher = f
+		element.finisherName = elementDefinition.Finisher
+	}
+	for _, derivedDefinition := range elementDefinition.Derived {
+		if derivedDefinition.Label == "" {
+			return fmt.Errorf("derived value of %s is missing a label", element.label)
+		}
+		if _, ok := labels[derivedDefinition.Label]; ok {
+			return fmt.Errorf("duplicate label %q derived from %s", derivedDefinition.Label, element.label)
+		}
+		labels[derivedDefinition.Label] = struct{}{}
+		f, err := lookupFinisher(derivedDefinition.Finisher)
+		if err != nil {
+			return fmt.Errorf("%s: %v", derivedDefinition.Label, err)
+		}
+		element.derived = append(element.derived, derivedElement{
+			label:        derivedDefinition.Label,
+			finisher:     f,
+			finisherName: derivedDefinition.Finisher,
+		})
+	}
+	return nil
+}
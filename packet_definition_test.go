@@ -0,0 +1,80 @@
+package fh4server
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketDefinitionFileMatchesBuiltIn(t *testing.T) {
+	r := require.New(t)
+	file, err := os.Open("packet_definitions/forza.json")
+	r.NoError(err)
+	defer file.Close()
+
+	formats, err := readPacketDefinition(file)
+	r.NoError(err)
+	r.Len(formats, len(packetFormats))
+	for _, format := range formats {
+		builtIn, ok := packetFormats[format.Name]
+		r.True(ok, "unknown format %s", format.Name)
+		r.Equal(builtIn.size, format.Size)
+		r.Len(format.elements, len(builtIn.elements))
+		for i, element := range format.elements {
+			expected := builtIn.elements[i]
+			r.Equal(expected.label, element.label)
+			r.Equal(expected.dataType, element.dataType)
+			r.Equal(expected.size, element.size)
+			r.Equal(expected.elementType, element.elementType, element.label)
+			r.Equal(expected.finisherName, element.finisherName, element.label)
+			r.Len(element.derived, len(expected.derived), element.label)
+			for j, derived := range element.derived {
+				r.Equal(expected.derived[j].label, derived.label)
+				r.Equal(expected.derived[j].finisherName, derived.finisherName)
+			}
+		}
+	}
+}
+
+func TestPacketDefinitionValidation(t *testing.T) {
+	testCases := map[string]string{
+		"elements add up to 5 bytes, expected 8": `{"formats": [{"name": "a", "size": 8, "elements": [
+			{"type": "s32", "label": "x", "kind": "field"}, {"type": "u8", "label": "y"}]}]}`,
+		`unknown type "f64"`: `{"formats": [{"name": "a", "size": 8, "elements": [
+			{"type": "f64", "label": "x", "kind": "field"}]}]}`,
+		`duplicate label "x"`: `{"formats": [{"name": "a", "size": 2, "elements": [
+			{"type": "u8", "label": "x"}, {"type": "u8", "label": "x"}]}]}`,
+		`unknown kind "metric"`: `{"formats": [{"name": "a", "size": 1, "elements": [
+			{"type": "u8", "label": "x", "kind": "metric"}]}]}`,
+		`unknown finisher "mps_to_furlongs"`: `{"formats": [{"name": "a", "size": 4, "elements": [
+			{"type": "f32", "label": "x", "derived": [{"label": "y", "finisher": "mps_to_furlongs"}]}]}]}`,
+		"must have a positive size": `{"formats": [{"name": "a", "size": 1, "elements": [
+			{"type": "skip"}]}]}`,
+	}
+	r := require.New(t)
+	for expectedErr, input := range testCases {
+		_, err := readPacketDefinition(strings.NewReader(input))
+		r.Error(err)
+		r.Contains(err.Error(), expectedErr)
+	}
+}
+
+func TestPacketDefinitionWithoutRaceOnFinisher(t *testing.T) {
+	r := require.New(t)
+	formats, err := readPacketDefinition(strings.NewReader(`{"formats": [{"name": "test", "size": 8, "elements": [
+		{"type": "s32", "label": "is_race_on", "kind": "tag"}, {"type": "u32", "label": "timestamp_ms", "kind": "timestamp"}]}]}`))
+	r.NoError(err)
+	format := registerPacketFormat("test", formats[0].elements)
+	defer delete(packetFormats, format.name)
+
+	packet, err := ParseBuf(bytes.NewBuffer([]byte{1, 0, 0, 0, 10, 0, 0, 0}), AllowAll())
+	r.NoError(err)
+	r.True(packet.IsRaceOn)
+	r.Equal("1", packet.Tags["is_race_on"])
+	packet, err = ParseBuf(bytes.NewBuffer(make([]byte, 8)), AllowAll())
+	r.NoError(err)
+	r.False(packet.IsRaceOn)
+}
@@ -0,0 +1,135 @@
+package fh4server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Encode serializes a packet back into the bytes sent by the game, using the
+// packet format named by packet.Format (or its packet_format tag). It is the
+// inverse of ParseBuf: encoding a parsed packet and parsing the result gives
+// back the same packet.
+//
+// Each element is read from the packet's fields or tags, and its finisher is
+// undone. Elements that are missing from the packet, e.g. because they were
+// not whitelisted, are recovered from their derived values where possible and
+// are otherwise encoded as zero. Skipped bytes, whose meaning is unknown, are
+// always encoded as zero.
+func Encode(packet Packet) ([]byte, error) {
+	name := packet.Format
+	if name == "" {
+		name = packet.Tags[formatTag]
+	}
+	format, ok := packetFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownFormat, name)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, format.size))
+	for _, element := range format.elements {
+		raw, err := packet.rawValue(element)
+		if err == nil {
+			err = element.encode(buf, raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s of %s packet: %v", element.label, format.name, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// rawValue returns the value of an element as it would be returned by the
+// element's parse function, or nil if the packet does not hold the element.
+func (packet Packet) rawValue(element *packetElement) (interface{}, error) {
+	if element.dataType == skipType {
+		return nil, nil
+	}
+	if element.elementType == timestamp {
+		return packet.TimestampMs, nil
+	}
+	if value, ok := packet.value(element.label, element.elementType); ok {
+		if element.finisher == nil {
+			return value, nil
+		}
+		inverse, ok := inverseFinishers[element.finisherName]
+		if !ok {
+			return nil, fmt.Errorf("finisher %q can't be undone", element.finisherName)
+		}
+		return inverse(value), nil
+	}
+	for _, derived := range element.derived {
+		value, ok := packet.value(derived.label, element.elementType)
+		inverse, invertible := inverseFinishers[derived.finisherName]
+		if ok && invertible {
+			return inverse(value), nil
+		}
+	}
+	if element.label == raceOnLabel {
+		return boolToInt(packet.IsRaceOn), nil
+	}
+	return nil, nil
+}
+
+// value looks up a finished value in the packet's fields or tags. Tags are
+// converted back from strings to numbers or bools.
+func (packet Packet) value(label string, elementType byte) (interface{}, bool) {
+	switch elementType {
+	case field:
+		value, ok := packet.Fields[label]
+		return value, ok && value != nil
+	case tag:
+		value, ok := packet.Tags[label]
+		if !ok {
+			return nil, false
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number, true
+		}
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, true
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+// encodeNumber converts any value that can be held by a packet element to a
+// float64. nil is zero.
+func encodeNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		return float64(boolToInt(v).(int32)), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	}
+	if v, ok := toFloat64(value); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported value %v (%T)", value, value)
+}
+
+// encodeInt converts a value to an integer in the range [min, max].
+func encodeInt(value interface{}, min, max float64) (int64, error) {
+	v, err := encodeNumber(value)
+	if err != nil {
+		return 0, err
+	}
+	v = math.Round(v)
+	if math.IsNaN(v) || v < min || v > max {
+		return 0, fmt.Errorf("%v out of range [%v, %v]", value, min, max)
+	}
+	return int64(v), nil
+}
+
+func encodeFloat(value interface{}) (float32, error) {
+	if v, ok := value.(float32); ok {
+		return v, nil
+	}
+	v, err := encodeNumber(value)
+	return float32(v), err
+}
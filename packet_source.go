@@ -2,28 +2,68 @@ package fh4server
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
 	udpListenPort = flag.Int("udp_listen_port", 10001, "port to listen for game messages on.")
 )
 
+var (
+	udpPacketsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fh4server_udp_packets_received_total",
+		Help: "Number of UDP packets received from the game, by packet format. Packets of no known size have format \"unknown\".",
+	}, []string{"format"})
+	udpBytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fh4server_udp_bytes_received_total",
+		Help: "Number of bytes received from the game.",
+	})
+	udpReadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fh4server_udp_read_errors_total",
+		Help: "Number of failed reads from the UDP socket.",
+	})
+)
+
 // PacketSource is implemented by anything that can provide game packets
-// (real, or fake) to the microservice.
+// (real, or fake) to the microservice. ReadNextPacket returns io.EOF when
+// there are no more packets.
 type PacketSource interface {
-	ReadNextPacket() *bytes.Buffer
+	ReadNextPacket() (*bytes.Buffer, PacketMetadata, error)
+}
+
+// PacketMetadata describes where and when a packet was received.
+type PacketMetadata struct {
+	// Source is the address the packet was sent from, or nil if it is not
+	// known, e.g. for simulated packets.
+	Source *net.UDPAddr
+	// ReceiveTime is when the packet was received. Packets read from a
+	// capture keep the time they were originally received.
+	ReceiveTime time.Time
+	// Length is the number of bytes in the packet.
+	Length int
 }
 
 // FH4Game implements PacketSource and uses Forza Horizon 4's Data Out setting
-// as a source of data.
+// as a source of data. Forza Motorsport 7's Sled and Dash formats are also
+// accepted, so FH4 and FM7 rigs can share one server.
+//
+// Every packet received can also be relayed to other telemetry apps, see
+// -forward_to.
 type FH4Game struct {
-	udpConn *net.UDPConn
-	buf     []byte
+	udpConn   *net.UDPConn
+	buf       []byte
+	forwarder *Forwarder
+	// closed is set to 1 by Close.
+	closed int32
 }
 
 // NewFH4Game sets up the UDP server for listening to game data messages being
@@ -42,25 +82,56 @@ func NewFH4Game() *FH4Game {
 
 	glog.Infof("listening on %v", udpAddr.String())
 
+	forwarder, err := NewForwarderFromFlags()
+	if err != nil {
+		glog.Fatalf("failed to set up forwarding: %v", err)
+	}
+
 	buf := make([]byte, 1024)
-	return &FH4Game{udpConn, buf}
+	return &FH4Game{udpConn: udpConn, buf: buf, forwarder: forwarder}
 }
 
 // Close should be called when the FH4Game is no longer needed. This closes the
-// udp connection.
-func (fh4Game *FH4Game) Close() {
-	fh4Game.udpConn.Close()
+// udp connection, which also interrupts a ReadNextPacket in progress.
+func (fh4Game *FH4Game) Close() error {
+	atomic.StoreInt32(&fh4Game.closed, 1)
+	err := fh4Game.udpConn.Close()
+	if fh4Game.forwarder != nil {
+		fh4Game.forwarder.Close()
+	}
 	glog.Infof("done")
+	return err
 }
 
-// ReadNextPacket blocks until receiving a UDP packet, reads it, and returns it.
-func (fh4Game *FH4Game) ReadNextPacket() *bytes.Buffer {
+// ReadNextPacket blocks until receiving a UDP packet, reads it, forwards it if
+// forwarding is set up, and returns it.
+func (fh4Game *FH4Game) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
 
-	n, _, err := fh4Game.udpConn.ReadFromUDP(fh4Game.buf)
+	n, addr, err := fh4Game.udpConn.ReadFromUDP(fh4Game.buf)
 	if err != nil {
-		glog.Errorf("failed to read from udp: %v", err)
+		udpReadErrors.Inc()
+		return nil, PacketMetadata{}, fmt.Errorf("failed to read from udp: %v", err)
 	}
+	udpBytesReceived.Add(float64(n))
+	metadata := PacketMetadata{Source: addr, ReceiveTime: time.Now(), Length: n}
 
 	packetBytes := fh4Game.buf[0:n]
-	return bytes.NewBuffer(packetBytes)
+	if fh4Game.forwarder != nil {
+		fh4Game.forwarder.Forward(packetBytes, addr)
+	}
+	if format := lookupPacketFormat(n); format != nil {
+		glog.V(2).Infof("received %s packet from %v", format.name, addr)
+		udpPacketsReceived.WithLabelValues(format.name).Inc()
+	} else {
+		udpPacketsReceived.WithLabelValues("unknown").Inc()
+	}
+	return bytes.NewBuffer(packetBytes), metadata, nil
+}
+
+// Healthy returns an error once the UDP listener has been closed.
+func (fh4Game *FH4Game) Healthy() error {
+	if atomic.LoadInt32(&fh4Game.closed) != 0 {
+		return errors.New("udp listener closed")
+	}
+	return nil
 }
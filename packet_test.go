@@ -1,13 +1,30 @@
 package fh4server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
 	"testing"
+	"testing/quick"
 
 	"github.com/stretchr/testify/require"
 )
 
+// testPacket is a base64 encoded FH4 packet (from logs).
+const testPacket = "AQAAAHGpEAD2//lF+P9HREg17ETOUljBxAq0vp6jGk" +
+	"AHMB9BgzqMPgAOVj/faPM9fXSzv8Yygry3H/w/9+gKvWx7s7vyegc/NSD9P" +
+	"lpD7D7ZpEo/43IfQG+03z/mgKtAzkzePwZWCz8L5qFASKvOQXFkYUEAAAAA" +
+	"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAJmZGT+ZmRk/mZkZP5mZGT8" +
+	"b06vAHRbewF+x7MBXmtjAWWu9QBYF5UDkJRJBbp7fQNDBPjzQQQg8IFO7O6" +
+	"QsFz0kBAAAAwAAACADAAACAAAABAAAACMAAAAAAAAAAAAAAJeqw8Lv3WtDx" +
+	"9qxxRPPH0EAAAAAAAAAAGVnm0LYSZpC/FaeQvxWnkLMdrLAAACAPwAAAAAA" +
+	"AAAAAAAAAAAAAABs2xdEAAAA/wAAAAGBAAAA"
+
 type parseTestCase struct {
 	// base64 encoded packet bytes (from logs)
 	input          string
@@ -35,7 +52,7 @@ func TestParseForValidCases(t *testing.T) {
 				"speed":      "9.988055",
 			},
 			expectedTags: map[string]interface{}{
-				"is_race_on":           "1",
+				"is_race_on":           "true",
 				"car_class":            "3",
 				"num_engine_cylinders": "4",
 			},
@@ -65,6 +82,236 @@ func TestParseForValidCases(t *testing.T) {
 	}
 }
 
+func TestParseDetectsFormat(t *testing.T) {
+	r := require.New(t)
+	fh4Bytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+
+	sledBytes := fh4Bytes[:232]
+	dashBytes := append(append([]byte{}, fh4Bytes[:232]...), fh4Bytes[244:323]...)
+
+	testCases := []struct {
+		input          []byte
+		expectedFormat string
+		expectedFields map[string]interface{}
+	}{
+		{fh4Bytes, FormatFH4, map[string]interface{}{"speed": "9.988055", "gear": 1}},
+		{dashBytes, FormatFM7Dash, map[string]interface{}{"speed": "9.988055", "gear": 1}},
+		{sledBytes, FormatFM7Sled, map[string]interface{}{"engine_max_rpm": "7999.995"}},
+	}
+	for _, testCase := range testCases {
+		actual := Parse(testCase.input, AllowAll())
+		r.Equal(testCase.expectedFormat, actual.Format)
+		r.Equal(testCase.expectedFormat, actual.Tags["packet_format"])
+		checkMap(r, testCase.expectedFields, actual.Fields)
+	}
+	r.NotContains(Parse(sledBytes, AllowAll()).Fields, "speed")
+}
+
+func TestParseAppliesFinishers(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+
+	actual := Parse(packetBytes, AllowList([]string{"speed", "speed_kph", "on_rumble_strip_front_left"}))
+	r.True(actual.IsRaceOn)
+	r.NotContains(actual.Tags, "is_race_on")
+	r.Equal(false, actual.Fields["on_rumble_strip_front_left"])
+	r.InDelta(9.988055*3.6, actual.Fields["speed_kph"], 0.0001)
+	r.NotContains(actual.Fields, "speed_mph")
+}
+
+func TestParseBufErrors(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+
+	_, err = ParseBuf(bytes.NewBuffer(packetBytes[:100]), AllowAll())
+	r.True(errors.Is(err, ErrShortPacket), "%v", err)
+
+	_, err = ParseBuf(bytes.NewBuffer(packetBytes[:300]), AllowAll())
+	r.True(errors.Is(err, ErrUnknownFormat), "%v", err)
+
+	oversized := append(append([]byte{}, packetBytes...), 1, 2, 3)
+	packet, err := ParseBuf(bytes.NewBuffer(oversized), AllowAll())
+	r.Equal(&TrailingBytesError{Format: FormatFH4, Count: 3}, err)
+	r.Equal(FormatFH4, packet.Format)
+	checkMap(r, map[string]interface{}{"speed": "9.988055"}, packet.Fields)
+}
+
+// randomPacketBytes returns a random packet of the given format which survives
+// a round trip through ParseBuf and Encode: skipped bytes are zero, booleans
+// are 0 or 1 and floats are not NaN.
+func randomPacketBytes(rng *rand.Rand, format *packetFormat) []byte {
+	packetBytes := make([]byte, format.size)
+	rng.Read(packetBytes)
+	offset := 0
+	for _, element := range format.elements {
+		b := packetBytes[offset : offset+element.size]
+		switch {
+		case element.dataType == skipType:
+			copy(b, make([]byte, len(b)))
+		case element.finisherName == "int_to_bool":
+			copy(b, make([]byte, len(b)))
+			b[0] = byte(rng.Intn(2))
+		case element.dataType == "f32":
+			if math.IsNaN(float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))) {
+				binary.LittleEndian.PutUint32(b, math.Float32bits(rng.Float32()))
+			}
+		}
+		offset += element.size
+	}
+	return packetBytes
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for name, format := range packetFormats {
+		format := format
+		roundTrip := func(seed int64) bool {
+			packetBytes := randomPacketBytes(rand.New(rand.NewSource(seed)), format)
+			packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			encoded, err := Encode(packet)
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			return bytes.Equal(packetBytes, encoded)
+		}
+		require.NoError(t, quick.Check(roundTrip, nil), name)
+	}
+}
+
+func TestEncodeZeroesUnknownBytes(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	r.NoError(err)
+
+	encoded, err := Encode(packet)
+	r.NoError(err)
+	r.Len(encoded, fh4PacketSize)
+	r.Equal(make([]byte, 12), encoded[fm7SledPacketSize:fh4DashOffset])
+	r.Equal(byte(0), encoded[fh4PacketSize-1])
+	r.Equal(packetBytes[:fm7SledPacketSize], encoded[:fm7SledPacketSize])
+	r.Equal(packetBytes[fh4DashOffset:fh4PacketSize-1], encoded[fh4DashOffset:fh4PacketSize-1])
+}
+
+func TestEncodeFilteredPacket(t *testing.T) {
+	r := require.New(t)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowList([]string{"speed_kph", "lap_number"}))
+	r.NoError(err)
+	packet.Format = ""
+	packet.Tags[formatTag] = FormatFH4
+
+	encoded, err := Encode(packet)
+	r.NoError(err)
+	reparsed, err := ParseBuf(bytes.NewBuffer(encoded), AllowAll())
+	r.NoError(err)
+	// speed is recovered from speed_kph, elements that were filtered out
+	// are zero.
+	r.InDelta(9.988055, reparsed.Fields["speed"], 0.0001)
+	r.Equal(packet.Tags["lap_number"], reparsed.Tags["lap_number"])
+	r.True(reparsed.IsRaceOn)
+	r.Equal(packet.TimestampMs, reparsed.TimestampMs)
+	r.Equal(float32(0), reparsed.Fields["current_engine_rpm"])
+
+	_, err = Encode(Packet{Format: "gt7"})
+	r.True(errors.Is(err, ErrUnknownFormat), "%v", err)
+
+	packet.Fields["race_position"] = 300
+	_, err = Encode(packet)
+	r.Error(err)
+}
+
+func TestTelemetryFrameMatchesParseBuf(t *testing.T) {
+	r := require.New(t)
+	fh4Bytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	sledBytes := fh4Bytes[:232]
+	dashBytes := append(append([]byte{}, fh4Bytes[:232]...), fh4Bytes[244:323]...)
+
+	for _, packetBytes := range [][]byte{fh4Bytes, sledBytes, dashBytes} {
+		expected, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+		r.NoError(err)
+
+		var frame TelemetryFrame
+		r.NoError(DecodeTelemetryFrame(packetBytes, &frame))
+		r.Equal(expected, frame.Packet(AllowAll()))
+		parsed, err := parseBufWithFrame(bytes.NewBuffer(packetBytes), AllowAll(), &frame)
+		r.NoError(err)
+		r.Equal(expected, parsed)
+
+		// Encoding the frame's packet gives back the original packet, apart
+		// from the unknown bytes in FH4 packets.
+		encoded, err := Encode(frame.Packet(AllowAll()))
+		r.NoError(err)
+		if frame.Format == FormatFH4 {
+			r.Equal(packetBytes[:232], encoded[:232])
+			r.Equal(packetBytes[244:323], encoded[244:323])
+		} else {
+			r.Equal(packetBytes, encoded)
+		}
+	}
+
+	var frame TelemetryFrame
+	// Packets which the frame can't decode are parsed with ParseBuf.
+	_, err = parseBufWithFrame(bytes.NewBuffer(append(fh4Bytes, 0)), AllowAll(), &frame)
+	r.IsType(&TrailingBytesError{}, err)
+	r.True(errors.Is(DecodeTelemetryFrame(fh4Bytes[:100], &frame), ErrShortPacket))
+	r.True(errors.Is(DecodeTelemetryFrame(fh4Bytes[:300], &frame), ErrUnknownFormat))
+}
+
+func TestTelemetryFrameHasEveryElement(t *testing.T) {
+	r := require.New(t)
+	var frame TelemetryFrame
+	for name := range builtInPacketDefinitions {
+		format, ok := telemetryFrameFormats[name]
+		r.True(ok, name)
+		values := frame.appendValues(nil, format.dash)
+		r.Len(values, len(format.elements), name)
+		// The values are listed in the same order as the packet's elements.
+		for i, element := range format.elements {
+			value, err := element.parse(bytes.NewBuffer(make([]byte, element.size)))
+			r.NoError(err)
+			r.Equal(reflect.TypeOf(value), reflect.TypeOf(values[i]), element.label)
+		}
+	}
+}
+
+func BenchmarkParseBuf(b *testing.B) {
+	packetBytes, _ := base64.StdEncoding.DecodeString(testPacket)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	}
+}
+
+func BenchmarkDecodeTelemetryFrame(b *testing.B) {
+	packetBytes, _ := base64.StdEncoding.DecodeString(testPacket)
+	var frame TelemetryFrame
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeTelemetryFrame(packetBytes, &frame)
+	}
+}
+
+func BenchmarkTelemetryFramePacket(b *testing.B) {
+	packetBytes, _ := base64.StdEncoding.DecodeString(testPacket)
+	var frame TelemetryFrame
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeTelemetryFrame(packetBytes, &frame)
+		frame.Packet(AllowAll())
+	}
+}
+
 func checkMap(r *require.Assertions, expected, actual map[string]interface{}) {
 	for k := range expected {
 		expectedStr := fmt.Sprintf("%v", expected[k])
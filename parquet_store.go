@@ -0,0 +1,365 @@
+package fh4server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+var (
+	parquetDir          = flag.String("parquet_dir", "", "when set, packets are also written to Parquet files in this directory, partitioned by date, session and car.")
+	parquetMaxRows      = flag.Int("parquet_max_rows", 100000, "with -parquet_dir, a new file is started once a file has this many rows.")
+	parquetRollInterval = flag.Duration("parquet_roll_interval", time.Hour, "with -parquet_dir, a new file is started once a file spans this much time. Files are also closed once they have received no packets for this long.")
+)
+
+// parquetRowGroupSize is the size of row group a ParquetStore buffers in
+// memory for each open file before writing it out.
+const parquetRowGroupSize = 8 * 1024 * 1024
+
+// parquetPartitionTags are the tags that packets are partitioned by, after
+// their date. They are not written as columns, as they are given by the
+// file's path.
+var parquetPartitionTags = []string{sessionTag, "car_id"}
+
+// parquetType is the Parquet type of a column, and the type of the values
+// written to it.
+type parquetType struct {
+	name   string
+	goType reflect.Type
+}
+
+// parquetTypes are the column types used for each type of field value.
+var parquetTypes = map[reflect.Kind]parquetType{
+	reflect.Bool:    {"BOOLEAN", reflect.TypeOf(false)},
+	reflect.Int8:    {"INT_8", reflect.TypeOf(int32(0))},
+	reflect.Uint8:   {"UINT_8", reflect.TypeOf(int32(0))},
+	reflect.Int16:   {"INT_16", reflect.TypeOf(int32(0))},
+	reflect.Uint16:  {"UINT_16", reflect.TypeOf(int32(0))},
+	reflect.Int32:   {"INT32", reflect.TypeOf(int32(0))},
+	reflect.Int:     {"INT64", reflect.TypeOf(int64(0))},
+	reflect.Uint32:  {"INT64", reflect.TypeOf(int64(0))},
+	reflect.Int64:   {"INT64", reflect.TypeOf(int64(0))},
+	reflect.Float32: {"FLOAT", reflect.TypeOf(float32(0))},
+	reflect.Float64: {"DOUBLE", reflect.TypeOf(float64(0))},
+	reflect.String:  {"UTF8", reflect.TypeOf("")},
+}
+
+// parquetColumns returns the packetColumns which have a Parquet type, apart
+// from the partition tags.
+func parquetColumns() []packetColumn {
+	partitionTags := make(map[string]bool)
+	for _, tag := range parquetPartitionTags {
+		partitionTags[tag] = true
+	}
+	var columns []packetColumn
+	for _, column := range packetColumns() {
+		if _, ok := parquetTypes[column.kind]; ok && !partitionTags[column.name] {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// parquetSchema returns the schema of a Parquet file with the columns, in the
+// form taken by writer.NewCSVWriter. Every column is optional.
+func parquetSchema(columns []packetColumn) []string {
+	schema := []string{"name=time, type=TIMESTAMP_MICROS", "name=extra, type=UTF8"}
+	for _, column := range columns {
+		schema = append(schema, fmt.Sprintf("name=%s, type=%s", column.name, parquetTypes[column.kind].name))
+	}
+	return schema
+}
+
+// parquetValue converts a packet value to the Go type written to a column of
+// the given kind, or returns nil if it can't be.
+func parquetValue(value interface{}, kind reflect.Kind) interface{} {
+	if value == nil {
+		return nil
+	}
+	target := parquetTypes[kind].goType
+	converted := reflect.ValueOf(value)
+	// Numbers convert to strings as runes, so only strings go in strings.
+	if (converted.Kind() == reflect.String) != (target.Kind() == reflect.String) || !converted.Type().ConvertibleTo(target) {
+		return nil
+	}
+	return converted.Convert(target).Interface()
+}
+
+// ParquetOptions configures a ParquetStore.
+type ParquetOptions struct {
+	// Dir is the directory the partitions are written to.
+	Dir string
+	// MaxRows is the number of rows after which a file is closed and a new one
+	// started. 0 means no limit.
+	MaxRows int
+	// RollInterval is the span of packet time after which a file is closed and
+	// a new one started. Files which receive no packets for this long are
+	// closed too. 0 means no limit.
+	RollInterval time.Duration
+}
+
+// ParquetOptionsFromFlags returns the ParquetOptions given by the
+// -parquet_* flags.
+func ParquetOptionsFromFlags() ParquetOptions {
+	return ParquetOptions{
+		Dir:          *parquetDir,
+		MaxRows:      *parquetMaxRows,
+		RollInterval: *parquetRollInterval,
+	}
+}
+
+// ParquetStore implements PacketStore by writing packets to Parquet files,
+// for analysis with tools like Spark, DuckDB or pandas.
+//
+// Files are partitioned by date, session and car, Hive style:
+//
+//	<dir>/date=2019-06-01/session_id=20190601T120000-1234/car_id=1234/part-20190601T120000.000000000.parquet
+//
+// and have a typed column for every field and tag in the packet definition,
+// apart from the partition tags, plus the packet's time and the JSON column
+// "extra" for fields and tags without a column. Files are written to a hidden
+// name, and only renamed to part-*.parquet once they are complete, so readers
+// never see a file which is being written. Lap and session summaries are not
+// written.
+type ParquetStore struct {
+	options ParquetOptions
+	columns []packetColumn
+	schema  []string
+
+	mu sync.Mutex
+	// files holds the open files by partition.
+	files *fileRotation
+	// latest is the time of the most recent packet written.
+	latest time.Time
+	// lastErr is the error returned by the most recent write.
+	lastErr error
+}
+
+// parquetFile is a file of a ParquetStore which is being written.
+type parquetFile struct {
+	path   string
+	file   source.ParquetFile
+	writer *writer.CSVWriter
+	// first and last are the times of the first and last packets written.
+	first time.Time
+	last  time.Time
+	rows  int
+	// maxRows is ParquetOptions.MaxRows.
+	maxRows int
+}
+
+// NewParquetStoreFromFlags returns a ParquetStore configured by the
+// -parquet_* flags, or nil if -parquet_dir is not set.
+func NewParquetStoreFromFlags() (*ParquetStore, error) {
+	if *parquetDir == "" {
+		return nil, nil
+	}
+	return NewParquetStore(ParquetOptionsFromFlags())
+}
+
+// NewParquetStore creates a store which writes to options.Dir. The packet
+// definition must be loaded first, so that every element has a column.
+func NewParquetStore(options ParquetOptions) (*ParquetStore, error) {
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", options.Dir, err)
+	}
+	store := &ParquetStore{
+		options: options,
+		columns: parquetColumns(),
+		files:   newFileRotation(options.RollInterval),
+	}
+	store.schema = parquetSchema(store.columns)
+	glog.Infof("writing packets to parquet files in %s with %d columns", options.Dir, len(store.schema))
+	return store, nil
+}
+
+// WritePacket appends the packet to the file of its partition.
+func (store *ParquetStore) WritePacket(packet Packet) {
+	if packet.Measurement != "" && packet.Measurement != packetMeasurement {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	err := store.writePacket(packet)
+	if err != nil {
+		glog.Warningf("failed to write packet to parquet: %v", err)
+	}
+	store.lastErr = err
+}
+
+func (store *ParquetStore) writePacket(packet Packet) error {
+	if packet.Timestamp.After(store.latest) {
+		store.latest = packet.Timestamp
+		if err := store.closeIdle(); err != nil {
+			return err
+		}
+	}
+
+	partition := store.partition(packet)
+	current, err := store.files.current(partition, packet.Timestamp)
+	if err != nil {
+		return err
+	}
+	file, _ := current.(*parquetFile)
+	if file == nil {
+		file, err = store.create(partition, packet.Timestamp)
+		if err != nil {
+			return err
+		}
+		store.files.start(partition, file)
+	}
+
+	if err := file.writer.Write(store.row(packet)); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", file.path, err)
+	}
+	file.rows++
+	file.last = packet.Timestamp
+	return nil
+}
+
+// partition returns the directory of the packet's partition, relative to
+// options.Dir.
+func (store *ParquetStore) partition(packet Packet) string {
+	parts := []string{"date=" + packet.Timestamp.UTC().Format("2006-01-02")}
+	for _, tag := range parquetPartitionTags {
+		value, ok := packet.Tags[tag]
+		if !ok || value == "" {
+			value = "none"
+		}
+		parts = append(parts, tag+"="+url.PathEscape(value))
+	}
+	return filepath.Join(parts...)
+}
+
+// closeIdle closes the files which have received no packets for
+// options.RollInterval, e.g. once a session has finished.
+func (store *ParquetStore) closeIdle() error {
+	if store.options.RollInterval <= 0 {
+		return nil
+	}
+	return store.files.endIf(func(file rotatingFile) bool {
+		return store.latest.Sub(file.(*parquetFile).last) >= store.options.RollInterval
+	})
+}
+
+// create starts a new file in the partition, named after the time of its
+// first packet.
+func (store *ParquetStore) create(partition string, first time.Time) (*parquetFile, error) {
+	dir := filepath.Join(store.options.Dir, partition)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	// Packets may share a time, so the first packets of two files can too.
+	path, err := uniquePath(dir, "part-"+first.UTC().Format("20060102T150405.000000000"), ".parquet")
+	if err != nil {
+		return nil, err
+	}
+	osFile, err := createUnique(inProgressPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	file := &local.LocalFile{FilePath: osFile.Name(), File: osFile}
+	parquetWriter, err := writer.NewCSVWriter(store.schema, file, 1)
+	if err != nil {
+		file.Close()
+		os.Remove(inProgressPath(path))
+		return nil, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	parquetWriter.RowGroupSize = parquetRowGroupSize
+	return &parquetFile{path: path, file: file, writer: parquetWriter, first: first, last: first, maxRows: store.options.MaxRows}, nil
+}
+
+// row returns the values of the file's columns for the packet, in the order
+// time, extra, then store.columns. The partition tags are left out.
+func (store *ParquetStore) row(packet Packet) []interface{} {
+	tags := make(map[string]string, len(packet.Tags))
+	for tag, value := range packet.Tags {
+		tags[tag] = value
+	}
+	for _, tag := range parquetPartitionTags {
+		delete(tags, tag)
+	}
+	packet.Tags = tags
+	values, extra := finiteColumnValues(packet, store.columns)
+	row := make([]interface{}, 0, len(values)+2)
+	row = append(row, packet.Timestamp.UnixNano()/int64(time.Microsecond), extra)
+	for i, value := range values {
+		row = append(row, parquetValue(value, store.columns[i].kind))
+	}
+	return row
+}
+
+func (file *parquetFile) started() time.Time {
+	return file.first
+}
+
+func (file *parquetFile) full() bool {
+	return file.maxRows > 0 && file.rows >= file.maxRows
+}
+
+// close writes out the file's footer, and renames it to its final name.
+func (file *parquetFile) close() error {
+	if err := file.writer.WriteStop(); err != nil {
+		file.file.Close()
+		return fmt.Errorf("failed to write %s: %v", file.path, err)
+	}
+	if err := file.file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", file.path, err)
+	}
+	if err := os.Rename(inProgressPath(file.path), file.path); err != nil {
+		return err
+	}
+	glog.V(1).Infof("wrote %d rows to %s", file.rows, file.path)
+	return nil
+}
+
+// Close completes every open file.
+func (store *ParquetStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.files.close()
+}
+
+// Healthy returns the error of the most recent write, if it failed.
+func (store *ParquetStore) Healthy() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lastErr != nil {
+		return fmt.Errorf("last write failed: %v", store.lastErr)
+	}
+	return nil
+}
+
+// ConvertCapture replays a capture file as fast as possible into a
+// ParquetStore, with the same processing as packets received from the game,
+// so that the files are the same as if the capture had been written live.
+// Unlike Run, it waits for the files to be completed however long it takes.
+func ConvertCapture(ctx context.Context, capture string, options ParquetOptions) error {
+	replay, err := NewReplayPacketSource(capture, 0)
+	if err != nil {
+		return err
+	}
+	store, err := NewParquetStore(options)
+	if err != nil {
+		replay.Close()
+		return err
+	}
+	// Run gives up on closing the store after -shutdown_timeout, so hide
+	// Close from it and close the store here instead.
+	err = Run(ctx, AllowAll(), replay, struct{ PacketStore }{store})
+	if closeErr := store.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
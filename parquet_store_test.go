@@ -0,0 +1,157 @@
+package fh4server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// parquetTestRow holds some of the columns of a ParquetStore's files.
+type parquetTestRow struct {
+	Time  *int64   `parquet:"name=time, type=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+	Extra *string  `parquet:"name=extra, type=UTF8, repetitiontype=OPTIONAL"`
+	Speed *float32 `parquet:"name=speed, type=FLOAT, repetitiontype=OPTIONAL"`
+	Gear  *int32   `parquet:"name=gear, type=UINT_8, repetitiontype=OPTIONAL"`
+}
+
+// readParquet returns the rows and schema of a Parquet file.
+func readParquet(r *require.Assertions, path string) ([]parquetTestRow, map[string]*parquet.SchemaElement) {
+	file, err := local.NewLocalFileReader(path)
+	r.NoError(err)
+	defer file.Close()
+	// NewParquetReader renames the schema after parquetTestRow, so the
+	// footer is read first.
+	footer := &reader.ParquetReader{PFile: file}
+	r.NoError(footer.ReadFooter())
+	schema := make(map[string]*parquet.SchemaElement)
+	for _, element := range footer.Footer.Schema[1:] {
+		schema[element.Name] = element
+	}
+	parquetReader, err := reader.NewParquetReader(file, new(parquetTestRow), 1)
+	r.NoError(err)
+	defer parquetReader.ReadStop()
+	rows := make([]parquetTestRow, parquetReader.GetNumRows())
+	r.NoError(parquetReader.Read(&rows))
+	return rows, schema
+}
+
+func TestParquetStore(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "parquet")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewParquetStore(ParquetOptions{Dir: dir, MaxRows: 2, RollInterval: time.Minute})
+	r.NoError(err)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	start := time.Unix(1559390400, 0)
+	write := func(session string, offset time.Duration, fields ...string) {
+		packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+		r.NoError(err)
+		// The given fields are set to NaN.
+		for _, field := range fields {
+			packet.Fields[field] = math.NaN()
+		}
+		packet.Timestamp = start.Add(offset)
+		packet.Tags[sessionTag] = session
+		packet.Tags["car_id"] = "1234"
+		store.WritePacket(packet)
+	}
+	write("first", 0)
+	write("first", time.Second)
+	write("first", 2*time.Second)
+	write("second/lap", 3*time.Second)
+	store.WritePacket(Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5}, Timestamp: start})
+	// A minute later, the idle file of the first session is closed.
+	write("second/lap", time.Minute+3*time.Second, "speed", "unknown")
+	r.NoError(store.Healthy())
+	matches, err := filepath.Glob(filepath.Join(dir, "date=2019-06-01", "session_id=first", "car_id=1234", "part-*.parquet"))
+	r.NoError(err)
+	r.Len(matches, 2)
+	r.NoError(store.Close())
+
+	files := make(map[string]int)
+	r.NoError(filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			relative, _ := filepath.Rel(dir, path)
+			rows, _ := readParquet(r, path)
+			files[relative] = len(rows)
+		}
+		return err
+	}))
+	r.Equal(map[string]int{
+		"date=2019-06-01/session_id=first/car_id=1234/part-20190601T120000.000000000.parquet":        2,
+		"date=2019-06-01/session_id=first/car_id=1234/part-20190601T120002.000000000.parquet":        1,
+		"date=2019-06-01/session_id=second%2Flap/car_id=1234/part-20190601T120003.000000000.parquet": 1,
+		"date=2019-06-01/session_id=second%2Flap/car_id=1234/part-20190601T120103.000000000.parquet": 1,
+	}, files)
+
+	rows, schema := readParquet(r, filepath.Join(dir, "date=2019-06-01/session_id=first/car_id=1234/part-20190601T120000.000000000.parquet"))
+	packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	r.NoError(err)
+	r.Equal(start.UnixNano()/int64(time.Microsecond), *rows[0].Time)
+	r.Equal(packet.Fields["speed"], *rows[0].Speed)
+	r.Equal(int32(packet.Fields["gear"].(uint8)), *rows[0].Gear)
+	r.Nil(rows[0].Extra)
+
+	r.Equal(parquet.Type_FLOAT, schema["speed"].GetType())
+	r.Equal(parquet.Type_INT32, schema["gear"].GetType())
+	r.Equal(parquet.ConvertedType_UINT_8, schema["gear"].GetConvertedType())
+	r.Equal(parquet.Type_INT64, schema["time"].GetType())
+	r.Equal(parquet.ConvertedType_TIMESTAMP_MICROS, schema["time"].GetConvertedType())
+	r.Equal(parquet.Type_BYTE_ARRAY, schema[sourceTag].GetType())
+	r.Equal(parquet.ConvertedType_UTF8, schema[sourceTag].GetConvertedType())
+	// Partition tags are only in the path.
+	r.NotContains(schema, sessionTag)
+	r.NotContains(schema, "car_id")
+
+	// NaN values are written as null, and left out of the extra values.
+	rows, _ = readParquet(r, filepath.Join(dir, "date=2019-06-01/session_id=second%2Flap/car_id=1234/part-20190601T120103.000000000.parquet"))
+	r.Nil(rows[0].Speed)
+	r.Nil(rows[0].Extra)
+}
+
+func TestConvertCapture(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "parquet")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	capture := filepath.Join(dir, "race.fh4cap")
+
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	packets := [][]byte{packetBytes, packetBytes, packetBytes}
+	recorder, err := NewRecordingPacketSource(&slicePacketSource{packets: packets, source: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}}, capture)
+	r.NoError(err)
+	for range packets {
+		_, _, err := recorder.ReadNextPacket()
+		r.NoError(err)
+	}
+	r.NoError(recorder.Close())
+
+	// Converting isn't limited by -shutdown_timeout.
+	defer func(timeout time.Duration) { *shutdownTimeout = timeout }(*shutdownTimeout)
+	*shutdownTimeout = time.Nanosecond
+
+	out := filepath.Join(dir, "out")
+	r.NoError(ConvertCapture(context.Background(), capture, ParquetOptions{Dir: out}))
+	matches, err := filepath.Glob(filepath.Join(out, "date=*", "session_id=*", "car_id=*", "*"))
+	r.NoError(err)
+	r.Len(matches, 1)
+	r.Regexp(`/part-[^/]*\.parquet$`, matches[0])
+	rows, _ := readParquet(r, matches[0])
+	r.Len(rows, len(packets))
+}
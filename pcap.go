@@ -0,0 +1,523 @@
+package fh4server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	replayPcap = flag.String("replay_pcap", "", "when set, packets sent to -udp_listen_port are read from this pcap or pcapng file (e.g. from tcpdump or Wireshark) instead of being received from the game.")
+)
+
+// Link layer types supported by PcapPacketSource. See
+// https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	ipProtocolUDP = 17
+)
+
+// errNotUDP is returned when a captured frame does not contain a UDP datagram.
+var errNotUDP = errors.New("not a udp datagram")
+
+// errMalformedPcap is returned when a capture file is corrupt.
+var errMalformedPcap = errors.New("malformed capture")
+
+// pcapMaxRecordSize is the largest record, or pcapng block, that is read from
+// a capture file, so that a corrupt length can't make the reader allocate
+// gigabytes. It is the default snaplen of tcpdump, far larger than any Forza
+// packet.
+const pcapMaxRecordSize = 256 * 1024
+
+// PcapPacketSource implements PacketSource by reading the payloads of UDP
+// datagrams from a pcap or pcapng capture file. Only datagrams sent to the
+// given destination port are returned. ReadNextPacket returns io.EOF at the end
+// of the capture.
+//
+// This is a minimal reader written for Forza captures, so it does not depend
+// on libpcap. It understands Ethernet (with VLAN tags), Linux cooked, raw IP
+// and BSD loopback captures of unfragmented IPv4 and IPv6 datagrams.
+type PcapPacketSource struct {
+	file   *os.File
+	reader pcapRecordReader
+	port   int
+}
+
+// pcapRecordReader is implemented by the pcap and pcapng file readers.
+type pcapRecordReader interface {
+	// nextRecord returns the next captured frame, and its link type.
+	nextRecord() (linkType uint16, captured time.Time, frame []byte, err error)
+}
+
+// NewPcapPacketSourceFromFlags opens the capture given by -replay_pcap,
+// filtered by -udp_listen_port. It returns nil if the flag is not set.
+func NewPcapPacketSourceFromFlags() (*PcapPacketSource, error) {
+	if *replayPcap == "" {
+		return nil, nil
+	}
+	return NewPcapPacketSource(*replayPcap, *udpListenPort)
+}
+
+// NewPcapPacketSource opens the pcap or pcapng file at `path`. Datagrams are
+// filtered by destination `port`, or not filtered if `port` is 0.
+func NewPcapPacketSource(path string, port int) (*PcapPacketSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pcap: %v", err)
+	}
+	reader, err := newPcapRecordReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	glog.Infof("reading packets sent to port %d from %s", port, path)
+	return &PcapPacketSource{file: file, reader: reader, port: port}, nil
+}
+
+// ReadNextPacket returns the payload of the next UDP datagram sent to the
+// port, along with its sender and capture time.
+func (pcap *PcapPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
+	for {
+		linkType, captured, frame, err := pcap.reader.nextRecord()
+		if err != nil {
+			return nil, PacketMetadata{}, err
+		}
+		datagram, err := udpPayload(linkType, frame)
+		if err != nil {
+			glog.V(2).Infof("skipping frame: %v", err)
+			continue
+		}
+		if pcap.port != 0 && int(datagram.dstPort) != pcap.port {
+			continue
+		}
+		metadata := PacketMetadata{
+			Source:      datagram.source,
+			ReceiveTime: captured,
+			Length:      len(datagram.payload),
+		}
+		return bytes.NewBuffer(datagram.payload), metadata, nil
+	}
+}
+
+// Close should be called when the PcapPacketSource is no longer needed.
+func (pcap *PcapPacketSource) Close() error {
+	return pcap.file.Close()
+}
+
+func newPcapRecordReader(r *bufio.Reader) (pcapRecordReader, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a pcap file: %v", err)
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return newClassicPcapReader(r)
+	case pcapngSectionHeader:
+		return &pcapngReader{r: r}, nil
+	}
+	return nil, fmt.Errorf("not a pcap file: unknown magic number %x", magic)
+}
+
+// classicPcapReader reads the original libpcap file format.
+type classicPcapReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	nanosecond bool
+	linkType   uint16
+}
+
+func newClassicPcapReader(r io.Reader) (*classicPcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("truncated pcap header: %v", err)
+	}
+	reader := &classicPcapReader{r: r}
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4:
+		reader.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		reader.order, reader.nanosecond = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		reader.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		reader.order, reader.nanosecond = binary.BigEndian, true
+	}
+	reader.linkType = uint16(reader.order.Uint32(header[20:24]))
+	return reader, nil
+}
+
+func (reader *classicPcapReader) nextRecord() (uint16, time.Time, []byte, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(reader.r, header[:]); err != nil {
+		return 0, time.Time{}, nil, truncatedAsEOF(err)
+	}
+	seconds := int64(reader.order.Uint32(header[0:4]))
+	fraction := int64(reader.order.Uint32(header[4:8]))
+	if !reader.nanosecond {
+		fraction *= 1000
+	}
+	length := reader.order.Uint32(header[8:12])
+	if length > pcapMaxRecordSize {
+		return 0, time.Time{}, nil, fmt.Errorf("%w: record of %d bytes is larger than %d", errMalformedPcap, length, pcapMaxRecordSize)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader.r, frame); err != nil {
+		return 0, time.Time{}, nil, truncatedAsEOF(err)
+	}
+	return reader.linkType, time.Unix(seconds, fraction), frame, nil
+}
+
+// pcapng block types.
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 0x00000001
+	pcapngSimplePacket         = 0x00000003
+	pcapngEnhancedPacket       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptionTSResol  = 9
+)
+
+// pcapngReader reads the pcapng file format.
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+type pcapngInterface struct {
+	linkType uint16
+	// unitsPerSecond is the resolution of timestamps.
+	unitsPerSecond uint64
+}
+
+func (reader *pcapngReader) nextRecord() (uint16, time.Time, []byte, error) {
+	for {
+		blockType, body, err := reader.nextBlock()
+		if err != nil {
+			return 0, time.Time{}, nil, err
+		}
+		switch blockType {
+		case pcapngInterfaceDescription:
+			if err := reader.addInterface(body); err != nil {
+				return 0, time.Time{}, nil, err
+			}
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return 0, time.Time{}, nil, fmt.Errorf("truncated enhanced packet block")
+			}
+			iface, err := reader.lookupInterface(reader.order.Uint32(body[0:4]))
+			if err != nil {
+				return 0, time.Time{}, nil, err
+			}
+			units := uint64(reader.order.Uint32(body[4:8]))<<32 | uint64(reader.order.Uint32(body[8:12]))
+			length := int(reader.order.Uint32(body[12:16]))
+			if 20+length > len(body) {
+				return 0, time.Time{}, nil, fmt.Errorf("truncated enhanced packet block")
+			}
+			return iface.linkType, iface.time(units), body[20 : 20+length], nil
+		case pcapngSimplePacket:
+			// Simple packets have no timestamp, and always belong to the
+			// first interface.
+			iface, err := reader.lookupInterface(0)
+			if err != nil {
+				return 0, time.Time{}, nil, err
+			}
+			if len(body) < 4 {
+				return 0, time.Time{}, nil, fmt.Errorf("truncated simple packet block")
+			}
+			length := int(reader.order.Uint32(body[0:4]))
+			if 4+length > len(body) {
+				length = len(body) - 4
+			}
+			return iface.linkType, time.Time{}, body[4 : 4+length], nil
+		}
+	}
+}
+
+// nextBlock reads the next block, handling section headers.
+func (reader *pcapngReader) nextBlock() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader.r, header[:]); err != nil {
+		return 0, nil, truncatedAsEOF(err)
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) == pcapngSectionHeader {
+		// The byte order of each section is given by its header, and each
+		// section has its own interfaces.
+		var magic [4]byte
+		if _, err := io.ReadFull(reader.r, magic[:]); err != nil {
+			return 0, nil, truncatedAsEOF(err)
+		}
+		if binary.LittleEndian.Uint32(magic[:]) == pcapngByteOrderMagic {
+			reader.order = binary.LittleEndian
+		} else if binary.BigEndian.Uint32(magic[:]) == pcapngByteOrderMagic {
+			reader.order = binary.BigEndian
+		} else {
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic %x", magic)
+		}
+		reader.interfaces = nil
+		totalLength := reader.order.Uint32(header[4:8])
+		if totalLength < 16 {
+			return 0, nil, fmt.Errorf("invalid pcapng section header length %d", totalLength)
+		}
+		if _, err := io.CopyN(ioutil.Discard, reader.r, int64(totalLength)-12); err != nil {
+			return 0, nil, truncatedAsEOF(err)
+		}
+		return pcapngSectionHeader, nil, nil
+	}
+	if reader.order == nil {
+		return 0, nil, fmt.Errorf("pcapng block before section header")
+	}
+	blockType := reader.order.Uint32(header[0:4])
+	totalLength := reader.order.Uint32(header[4:8])
+	if totalLength < 12 || totalLength%4 != 0 {
+		return 0, nil, fmt.Errorf("%w: invalid pcapng block length %d", errMalformedPcap, totalLength)
+	}
+	if totalLength > pcapMaxRecordSize {
+		return 0, nil, fmt.Errorf("%w: pcapng block of %d bytes is larger than %d", errMalformedPcap, totalLength, pcapMaxRecordSize)
+	}
+	block := make([]byte, totalLength-8)
+	if _, err := io.ReadFull(reader.r, block); err != nil {
+		return 0, nil, truncatedAsEOF(err)
+	}
+	// The body is followed by a repeat of the total length.
+	return blockType, block[:len(block)-4], nil
+}
+
+// addInterface reads an interface description block. Timestamp resolutions
+// finer than a uint64 can count in a second are rejected.
+func (reader *pcapngReader) addInterface(body []byte) error {
+	iface := pcapngInterface{unitsPerSecond: 1000000}
+	if len(body) >= 8 {
+		iface.linkType = reader.order.Uint16(body[0:2])
+		options := body[8:]
+		for len(options) >= 4 {
+			code := reader.order.Uint16(options[0:2])
+			length := int(reader.order.Uint16(options[2:4]))
+			if code == 0 || 4+length > len(options) {
+				break
+			}
+			if code == pcapngOptionTSResol && length >= 1 {
+				resolution := options[4]
+				exponent := int(resolution & 0x7f)
+				if resolution&0x80 == 0 {
+					if exponent > 19 {
+						return fmt.Errorf("%w: pcapng timestamp resolution of 10^-%d seconds is too fine", errMalformedPcap, exponent)
+					}
+					iface.unitsPerSecond = 1
+					for i := 0; i < exponent; i++ {
+						iface.unitsPerSecond *= 10
+					}
+				} else {
+					if exponent > 63 {
+						return fmt.Errorf("%w: pcapng timestamp resolution of 2^-%d seconds is too fine", errMalformedPcap, exponent)
+					}
+					iface.unitsPerSecond = 1 << exponent
+				}
+			}
+			options = options[4+(length+3)/4*4:]
+		}
+	}
+	reader.interfaces = append(reader.interfaces, iface)
+	return nil
+}
+
+func (reader *pcapngReader) lookupInterface(id uint32) (pcapngInterface, error) {
+	if int(id) >= len(reader.interfaces) {
+		return pcapngInterface{}, fmt.Errorf("packet for unknown pcapng interface %d", id)
+	}
+	return reader.interfaces[id], nil
+}
+
+func (iface pcapngInterface) time(units uint64) time.Time {
+	seconds := units / iface.unitsPerSecond
+	remainder := units % iface.unitsPerSecond
+	// remainder*time.Second can overflow for resolutions finer than a
+	// nanosecond, so the product is kept in 128 bits.
+	hi, lo := bits.Mul64(remainder, uint64(time.Second))
+	nanoseconds, _ := bits.Div64(hi, lo, iface.unitsPerSecond)
+	return time.Unix(int64(seconds), int64(nanoseconds))
+}
+
+// udpDatagram is a UDP datagram extracted from a captured frame.
+type udpDatagram struct {
+	source  *net.UDPAddr
+	dstPort uint16
+	payload []byte
+}
+
+// udpPayload extracts the sender, destination port and payload of the UDP
+// datagram in a captured frame.
+func udpPayload(linkType uint16, frame []byte) (udpDatagram, error) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return udpDatagram{}, fmt.Errorf("truncated ethernet frame")
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(frame) < 4 {
+				return udpDatagram{}, fmt.Errorf("truncated vlan tag")
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return udpDatagram{}, fmt.Errorf("truncated linux cooked frame")
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+		frame = frame[16:]
+	case linkTypeLinuxSLL2:
+		if len(frame) < 20 {
+			return udpDatagram{}, fmt.Errorf("truncated linux cooked frame")
+		}
+		etherType = binary.BigEndian.Uint16(frame[0:2])
+		frame = frame[20:]
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return udpDatagram{}, fmt.Errorf("truncated loopback frame")
+		}
+		// The address family is in the byte order of the capturing host.
+		family := binary.LittleEndian.Uint32(frame[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(frame[0:4])
+		}
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 24, 28, 30:
+			etherType = etherTypeIPv6
+		}
+		frame = frame[4:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		if len(frame) < 1 {
+			return udpDatagram{}, fmt.Errorf("empty frame")
+		}
+		switch frame[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	default:
+		return udpDatagram{}, fmt.Errorf("unsupported link type %d", linkType)
+	}
+
+	var srcIP net.IP
+	var udp []byte
+	var err error
+	switch etherType {
+	case etherTypeIPv4:
+		srcIP, udp, err = ipv4UDP(frame)
+	case etherTypeIPv6:
+		srcIP, udp, err = ipv6UDP(frame)
+	default:
+		return udpDatagram{}, errNotUDP
+	}
+	if err != nil {
+		return udpDatagram{}, err
+	}
+	if len(udp) < 8 {
+		return udpDatagram{}, fmt.Errorf("truncated udp header")
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return udpDatagram{}, fmt.Errorf("invalid udp length %d", length)
+	}
+	return udpDatagram{
+		source:  &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(udp[0:2]))},
+		dstPort: binary.BigEndian.Uint16(udp[2:4]),
+		payload: udp[8:length],
+	}, nil
+}
+
+// ipv4UDP returns the source address and UDP datagram of an IPv4 packet.
+func ipv4UDP(packet []byte) (net.IP, []byte, error) {
+	if len(packet) < 20 {
+		return nil, nil, fmt.Errorf("truncated ipv4 header")
+	}
+	headerLength := int(packet[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLength < 20 || totalLength < headerLength || totalLength > len(packet) {
+		return nil, nil, fmt.Errorf("invalid ipv4 header")
+	}
+	if packet[9] != ipProtocolUDP {
+		return nil, nil, errNotUDP
+	}
+	// Fragmented datagrams are not reassembled.
+	if flagsAndOffset := binary.BigEndian.Uint16(packet[6:8]); flagsAndOffset&0x3fff != 0 {
+		return nil, nil, fmt.Errorf("fragmented ipv4 datagram")
+	}
+	return append(net.IP(nil), packet[12:16]...), packet[headerLength:totalLength], nil
+}
+
+// ipv6UDP returns the source address and UDP datagram of an IPv6 packet.
+func ipv6UDP(packet []byte) (net.IP, []byte, error) {
+	if len(packet) < 40 {
+		return nil, nil, fmt.Errorf("truncated ipv6 header")
+	}
+	payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+	if 40+payloadLength > len(packet) {
+		return nil, nil, fmt.Errorf("invalid ipv6 payload length")
+	}
+	nextHeader := packet[6]
+	payload := packet[40 : 40+payloadLength]
+	for {
+		switch nextHeader {
+		case ipProtocolUDP:
+			return append(net.IP(nil), packet[8:24]...), payload, nil
+		case 0, 43, 60: // hop-by-hop, routing and destination options
+			if len(payload) < 8 {
+				return nil, nil, fmt.Errorf("truncated ipv6 extension header")
+			}
+			length := (int(payload[1]) + 1) * 8
+			if length > len(payload) {
+				return nil, nil, fmt.Errorf("truncated ipv6 extension header")
+			}
+			nextHeader = payload[0]
+			payload = payload[length:]
+		case 44: // fragment
+			return nil, nil, fmt.Errorf("fragmented ipv6 datagram")
+		default:
+			return nil, nil, errNotUDP
+		}
+	}
+}
+
+// truncatedAsEOF treats a capture that ends part way through a record as
+// having ended before it.
+func truncatedAsEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		glog.Warningf("capture ends with a truncated record")
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// udpFrame builds an Ethernet frame holding a UDP datagram.
+func udpFrame(ipv6 bool, dstPort uint16, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], 50000)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	ethernet := make([]byte, 14)
+	var ip []byte
+	if ipv6 {
+		binary.BigEndian.PutUint16(ethernet[12:14], etherTypeIPv6)
+		ip = make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(udp)))
+		ip[6] = ipProtocolUDP
+		copy(ip[8:24], net.ParseIP("fd00::20"))
+	} else {
+		binary.BigEndian.PutUint16(ethernet[12:14], etherTypeIPv4)
+		ip = make([]byte, 20)
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+		ip[9] = ipProtocolUDP
+		copy(ip[12:16], net.IPv4(192, 168, 1, 20).To4())
+	}
+	return append(append(ethernet, ip...), udp...)
+}
+
+func writeTestCapture(r *require.Assertions, contents []byte) string {
+	file, err := ioutil.TempFile("", "pcap")
+	r.NoError(err)
+	defer file.Close()
+	_, err = file.Write(contents)
+	r.NoError(err)
+	return file.Name()
+}
+
+func readAllPcap(r *require.Assertions, path string, port int) ([]string, []PacketMetadata) {
+	source, err := NewPcapPacketSource(path, port)
+	r.NoError(err)
+	defer source.Close()
+	var payloads []string
+	var metadata []PacketMetadata
+	for {
+		buf, packetMetadata, err := source.ReadNextPacket()
+		if err == io.EOF {
+			return payloads, metadata
+		}
+		r.NoError(err)
+		payloads = append(payloads, buf.String())
+		metadata = append(metadata, packetMetadata)
+	}
+}
+
+func TestPcapPacketSource(t *testing.T) {
+	r := require.New(t)
+	frames := [][]byte{
+		udpFrame(false, 10001, []byte("first")),
+		udpFrame(false, 53, []byte("dns")),
+		udpFrame(true, 10001, []byte("second")),
+	}
+
+	var pcap bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeEthernet)
+	pcap.Write(header)
+	for i, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], 1559390400)
+		binary.LittleEndian.PutUint32(record[4:8], uint32(i*1000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+		pcap.Write(record)
+		pcap.Write(frame)
+	}
+	path := writeTestCapture(r, pcap.Bytes())
+	defer os.Remove(path)
+
+	payloads, metadata := readAllPcap(r, path, 10001)
+	r.Equal([]string{"first", "second"}, payloads)
+	r.Equal(time.Unix(1559390400, 2000000), metadata[1].ReceiveTime)
+	r.Equal("192.168.1.20:50000", metadata[0].Source.String())
+	r.Equal("[fd00::20]:50000", metadata[1].Source.String())
+	r.Equal(len("second"), metadata[1].Length)
+
+	payloads, _ = readAllPcap(r, path, 0)
+	r.Len(payloads, 3)
+}
+
+func TestPcapngPacketSource(t *testing.T) {
+	r := require.New(t)
+	block := func(blockType uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b := make([]byte, 8, 12+len(body))
+		binary.LittleEndian.PutUint32(b[0:4], blockType)
+		binary.LittleEndian.PutUint32(b[4:8], uint32(12+len(body)))
+		b = append(b, body...)
+		return append(b, b[4:8]...)
+	}
+
+	var pcapng bytes.Buffer
+	sectionHeader := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sectionHeader[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(sectionHeader[4:6], 1)
+	pcapng.Write(block(pcapngSectionHeader, sectionHeader))
+
+	// An interface with nanosecond timestamps.
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:2], linkTypeEthernet)
+	iface = append(iface, pcapngOptionTSResol, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0)
+	pcapng.Write(block(pcapngInterfaceDescription, iface))
+
+	frame := udpFrame(false, 10001, []byte("packet"))
+	units := uint64(time.Unix(1559390400, 123456789).UnixNano())
+	packet := make([]byte, 20)
+	binary.LittleEndian.PutUint32(packet[4:8], uint32(units>>32))
+	binary.LittleEndian.PutUint32(packet[8:12], uint32(units))
+	binary.LittleEndian.PutUint32(packet[12:16], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(packet[16:20], uint32(len(frame)))
+	pcapng.Write(block(pcapngEnhancedPacket, append(packet, frame...)))
+
+	path := writeTestCapture(r, pcapng.Bytes())
+	defer os.Remove(path)
+
+	payloads, metadata := readAllPcap(r, path, 10001)
+	r.Equal([]string{"packet"}, payloads)
+	r.Equal(time.Unix(1559390400, 123456789), metadata[0].ReceiveTime)
+}
+
+func TestPcapOversizedRecord(t *testing.T) {
+	r := require.New(t)
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeEthernet)
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:12], 0xffffffff)
+	path := writeTestCapture(r, append(header, record...))
+	defer os.Remove(path)
+	source, err := NewPcapPacketSource(path, 0)
+	r.NoError(err)
+	defer source.Close()
+	_, _, err = source.ReadNextPacket()
+	r.True(errors.Is(err, errMalformedPcap), "%v", err)
+
+	pcapng := make([]byte, 8)
+	binary.LittleEndian.PutUint32(pcapng[0:4], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(pcapng[4:8], 0xfffffffc)
+
+	reader := &pcapngReader{r: bytes.NewReader(pcapng), order: binary.LittleEndian}
+	_, _, _, err = reader.nextRecord()
+	r.True(errors.Is(err, errMalformedPcap), "%v", err)
+}
+
+func TestPcapngTimestampResolution(t *testing.T) {
+	r := require.New(t)
+	reader := &pcapngReader{order: binary.LittleEndian}
+	addInterface := func(resolution byte) error {
+		iface := make([]byte, 8)
+		binary.LittleEndian.PutUint16(iface[0:2], linkTypeEthernet)
+		return reader.addInterface(append(iface, pcapngOptionTSResol, 0, 1, 0, resolution, 0, 0, 0))
+	}
+	for _, resolution := range []byte{20, 127, 0x80 | 64, 0xff} {
+		err := addInterface(resolution)
+		r.True(errors.Is(err, errMalformedPcap), "resolution %#x: %v", resolution, err)
+	}
+
+	// Resolutions finer than a nanosecond are rounded down to one.
+	r.NoError(addInterface(19))
+	r.NoError(addInterface(0x80 | 63))
+	r.NoError(addInterface(12))
+	picoseconds := reader.interfaces[len(reader.interfaces)-1]
+	r.Equal(time.Unix(5, 123456789), picoseconds.time(5123456789123))
+	r.Equal(time.Unix(1, 500000000), reader.interfaces[1].time(1<<63+1<<62))
+}
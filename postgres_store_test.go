@@ -0,0 +1,110 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresColumns(t *testing.T) {
+	r := require.New(t)
+	columns := make(map[string]packetColumn)
+	for _, column := range postgresColumns() {
+		columns[column.name] = column
+	}
+	r.Equal(packetColumn{name: "speed", kind: reflect.Float32}, columns["speed"])
+	// Derived values and finishers are accounted for.
+	r.Equal(packetColumn{name: "speed_kph", kind: reflect.Float32}, columns["speed_kph"])
+	r.Equal(packetColumn{name: "gear", kind: reflect.Uint8}, columns["gear"])
+	r.Equal(packetColumn{name: "car_id", kind: reflect.String, tag: true}, columns["car_id"])
+	r.Equal(packetColumn{name: sessionTag, kind: reflect.String, tag: true}, columns[sessionTag])
+	r.NotContains(columns, "timestamp_ms")
+
+	schema := postgresSchema("fh4", []packetColumn{columns["speed"], columns["car_id"]}, false)
+	r.Equal([]string{
+		`CREATE TABLE IF NOT EXISTS "fh4" ("time" timestamptz NOT NULL, "extra" jsonb)`,
+		`ALTER TABLE "fh4" ADD COLUMN IF NOT EXISTS "speed" real, ADD COLUMN IF NOT EXISTS "car_id" text`,
+		`CREATE INDEX IF NOT EXISTS "fh4_time_idx" ON "fh4" ("time" DESC)`,
+		`CREATE INDEX IF NOT EXISTS "fh4_car_id_idx" ON "fh4" ("car_id", "time" DESC)`,
+	}, schema)
+	schema = postgresSchema("fh4", nil, true)
+	r.Contains(schema, `SELECT create_hypertable('"fh4"', 'time', if_not_exists => TRUE, migrate_data => TRUE)`)
+}
+
+func TestPostgresRow(t *testing.T) {
+	r := require.New(t)
+	store := &PostgresStore{columns: []packetColumn{
+		{name: "car_id", kind: reflect.String, tag: true},
+		{name: "gear", kind: reflect.Uint8},
+		{name: "speed", kind: reflect.Float32},
+	}}
+	timestamp := time.Unix(1559390400, 0)
+	row := store.row(Packet{
+		Fields:    map[string]interface{}{"speed": float32(23.5), "boost": float32(1)},
+		Tags:      map[string]string{"car_id": "1234", "track": "goliath"},
+		Timestamp: timestamp,
+	})
+	r.Equal(timestamp, row[0])
+	r.JSONEq(`{"fields":{"boost":1},"tags":{"track":"goliath"}}`, row[1].(string))
+	r.Equal([]interface{}{"1234", nil, float32(23.5)}, row[2:])
+
+	row = store.row(Packet{Fields: map[string]interface{}{"speed": float32(1)}})
+	r.Nil(row[1])
+
+	// NaN and infinite values, which JSON can't represent, are written as
+	// NULL, or left out of the JSON columns.
+	row = store.row(Packet{Fields: map[string]interface{}{
+		"speed": float32(math.NaN()), "boost": math.Inf(1), "power": float32(2),
+	}})
+	r.JSONEq(`{"fields":{"power":2}}`, row[1].(string))
+	r.Equal([]interface{}{nil, nil, nil}, row[2:])
+	row = summaryRow(Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5, "avg_throttle": math.NaN()}, Timestamp: timestamp})
+	r.JSONEq(`{"lap_time":60.5}`, row[2].(string))
+}
+
+// TestPostgresStore writes to the database given by FH4SERVER_TEST_POSTGRES_DSN,
+// and is skipped if it is not set.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("FH4SERVER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FH4SERVER_TEST_POSTGRES_DSN is not set")
+	}
+	r := require.New(t)
+	table := "fh4_test_" + time.Now().Format("20060102150405")
+	store, err := NewPostgresStore(dsn, table, false)
+	r.NoError(err)
+	defer store.Close()
+	defer store.db.Exec(`DROP TABLE "` + table + `"`)
+
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	r.NoError(err)
+	packet.Timestamp = time.Unix(1559390400, 0)
+	lap := Packet{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5}, Timestamp: packet.Timestamp}
+	r.NoError(store.WritePackets([]Packet{packet, packet, lap}))
+	r.NoError(store.Healthy())
+
+	var count int
+	var speed float32
+	var carID string
+	r.NoError(store.db.QueryRow(`SELECT count(*), max(speed), max(car_id) FROM "`+table+`"`).Scan(&count, &speed, &carID))
+	r.Equal(2, count)
+	r.Equal(packet.Fields["speed"], speed)
+	r.Equal(packet.Tags["car_id"], carID)
+
+	var fields []byte
+	r.NoError(store.db.QueryRow(`SELECT fields FROM "`+lapMeasurement+`" WHERE "time" = $1`, packet.Timestamp).Scan(&fields))
+	var decoded map[string]interface{}
+	r.NoError(json.Unmarshal(fields, &decoded))
+	r.Equal(60.5, decoded["lap_time"])
+	_, err = store.db.Exec(`DELETE FROM "`+lapMeasurement+`" WHERE "time" = $1`, packet.Timestamp)
+	r.NoError(err)
+}
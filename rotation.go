@@ -0,0 +1,127 @@
+package fh4server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxNameCollisions is how many files can start at the same time before
+// creating another one fails.
+const maxNameCollisions = 1000
+
+// fileRotation holds the open files of a store which writes packets to
+// files, such as FileStore and ParquetStore, and rotates them: a file is
+// closed and a new one started once it is full, or spans interval.
+//
+// Files are named after the time of their first packet. Time is packet time
+// rather than wall time, so that replaying a capture gives the same files as
+// receiving it live.
+//
+// A fileRotation is not safe for concurrent use.
+type fileRotation struct {
+	// interval is the span of packet time after which a file is rotated. 0
+	// means no limit.
+	interval time.Duration
+	// files holds the open files by key, e.g. partition or session.
+	files map[string]rotatingFile
+}
+
+// rotatingFile is an open file of a fileRotation.
+type rotatingFile interface {
+	// started returns the time of the first packet written.
+	started() time.Time
+	// full returns whether the file has reached its size limit.
+	full() bool
+	// close completes the file.
+	close() error
+}
+
+func newFileRotation(interval time.Duration) *fileRotation {
+	return &fileRotation{interval: interval, files: make(map[string]rotatingFile)}
+}
+
+// current returns the file open for key, or nil if a packet at timestamp
+// should start a new file. A file which is due to be rotated is closed.
+func (rotation *fileRotation) current(key string, timestamp time.Time) (rotatingFile, error) {
+	file := rotation.files[key]
+	if file == nil {
+		return nil, nil
+	}
+	if !file.full() && (rotation.interval <= 0 || timestamp.Sub(file.started()) < rotation.interval) {
+		return file, nil
+	}
+	return nil, rotation.end(key)
+}
+
+// start adds a new file, which must have been created with uniquePath, for
+// key.
+func (rotation *fileRotation) start(key string, file rotatingFile) {
+	rotation.files[key] = file
+}
+
+// end closes the file open for key, if there is one.
+func (rotation *fileRotation) end(key string) error {
+	file := rotation.files[key]
+	if file == nil {
+		return nil
+	}
+	delete(rotation.files, key)
+	return file.close()
+}
+
+// endIf closes the files for which done returns true.
+func (rotation *fileRotation) endIf(done func(file rotatingFile) bool) error {
+	var failed []string
+	for key, file := range rotation.files {
+		if !done(file) {
+			continue
+		}
+		if err := rotation.end(key); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// close closes every open file.
+func (rotation *fileRotation) close() error {
+	return rotation.endIf(func(rotatingFile) bool { return true })
+}
+
+// uniquePath returns dir/<name><extension>, or dir/<name>-<n><extension> if
+// that is taken, e.g. by a file which started at the same time. A name is
+// taken if the file, or its inProgressPath, exists.
+func uniquePath(dir, name, extension string) (string, error) {
+	path := filepath.Join(dir, name+extension)
+	for i := 1; i < maxNameCollisions; i++ {
+		if !fileExists(path) && !fileExists(inProgressPath(path)) {
+			return path, nil
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, i, extension))
+	}
+	return "", fmt.Errorf("%d files named %s%s already exist", maxNameCollisions, filepath.Join(dir, name), extension)
+}
+
+// createUnique creates the file at path, failing if it already exists rather
+// than overwriting it.
+func createUnique(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// inProgressPath returns the hidden name a file is written to until it is
+// complete.
+func inProgressPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".inprogress")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,42 @@
+package fh4server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniquePath(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "rotation")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	touch := func(name string) {
+		r.NoError(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	path, err := uniquePath(dir, "part", ".csv")
+	r.NoError(err)
+	r.Equal(filepath.Join(dir, "part.csv"), path)
+	// Files which are still being written take their name too.
+	touch("part.csv")
+	touch(".part-1.csv.inprogress")
+	path, err = uniquePath(dir, "part", ".csv")
+	r.NoError(err)
+	r.Equal(filepath.Join(dir, "part-2.csv"), path)
+
+	// Once every name is taken, existing files are left alone.
+	for i := 2; i < maxNameCollisions; i++ {
+		touch(fmt.Sprintf("part-%d.csv", i))
+	}
+	_, err = uniquePath(dir, "part", ".csv")
+	r.Error(err)
+	r.Contains(err.Error(), "already exist")
+	touch("taken")
+	_, err = createUnique(filepath.Join(dir, "taken"))
+	r.True(os.IsExist(err))
+}
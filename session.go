@@ -0,0 +1,246 @@
+package fh4server
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	trackSessions = flag.Bool("track_sessions", true, "when enabled, lap and session summaries are written along with the packets.")
+)
+
+// Measurements used for the packets written to a PacketStore.
+const (
+	// packetMeasurement is used for packets parsed from the game.
+	packetMeasurement = "fh4"
+	// lapMeasurement is used for lap summaries written by SessionTracker.
+	lapMeasurement = "fh4_lap"
+	// sessionMeasurement is used for session summaries written by
+	// SessionTracker.
+	sessionMeasurement = "fh4_session"
+)
+
+// sessionTag is added to every packet that is part of a session.
+const sessionTag = "session_id"
+
+// SessionTracker splits the packet stream up into sessions and laps, and
+// writes a summary packet to a PacketStore at the end of each.
+//
+// A session starts when is_race_on becomes true, and ends when it becomes
+// false or when car_id changes. A lap ends each time lap_number increments.
+type SessionTracker struct {
+	store PacketStore
+
+	// session is nil when there is no session in progress.
+	session *sessionSummary
+	lap     *lapSummary
+}
+
+// sessionSummary accumulates the statistics for a session.
+type sessionSummary struct {
+	id          string
+	carID       string
+	driver      string
+	start       time.Time
+	end         time.Time
+	laps        int
+	bestLapTime float64
+	stats       drivingStats
+}
+
+// lapSummary accumulates the statistics for a single lap.
+type lapSummary struct {
+	format          string
+	number          int
+	start           time.Time
+	lastCurrentTime float64
+	stats           drivingStats
+}
+
+// drivingStats are the statistics shared by laps and sessions.
+type drivingStats struct {
+	topSpeed      float64
+	throttleTotal float64
+	samples       int
+	startDistance float64
+	lastDistance  float64
+}
+
+// NewSessionTracker returns a SessionTracker which writes summaries to `store`.
+func NewSessionTracker(store PacketStore) *SessionTracker {
+	return &SessionTracker{store: store}
+}
+
+// Track updates the session state with the next packet, which must have been
+// parsed with every label allowed. Packets that are part of a session are
+// tagged with the session id.
+func (tracker *SessionTracker) Track(packet Packet) {
+	timestamp := packet.Timestamp
+	carID := packet.Tags["car_id"]
+	if tracker.session != nil && (!packet.IsRaceOn || carID != tracker.session.carID) {
+		tracker.endSession()
+	}
+	if !packet.IsRaceOn {
+		return
+	}
+	if tracker.session == nil {
+		// The driver is part of the id so that cars starting a session at
+		// the same time get different ids.
+		id := timestamp.UTC().Format("20060102T150405")
+		driver := packet.Tags[driverTag]
+		if driver != "" {
+			id += "-" + driver
+		}
+		tracker.session = &sessionSummary{
+			id:     fmt.Sprintf("%s-%s", id, carID),
+			carID:  carID,
+			driver: driver,
+			start:  timestamp,
+		}
+	}
+	session := tracker.session
+	session.end = timestamp
+	session.stats.add(packet)
+	packet.Tags[sessionTag] = session.id
+
+	lapNumber, ok := tagInt(packet, "lap_number")
+	if !ok {
+		// Formats without lap information only get session summaries.
+		return
+	}
+	if tracker.lap != nil && lapNumber > tracker.lap.number {
+		tracker.endLap(packet)
+	}
+	if tracker.lap == nil || lapNumber != tracker.lap.number {
+		tracker.lap = &lapSummary{format: packet.Format, number: lapNumber, start: timestamp}
+	}
+	tracker.lap.stats.add(packet)
+	tracker.lap.lastCurrentTime, _ = fieldFloat(packet, "current_lap_time")
+}
+
+// endLap writes the summary of the current lap. `packet` is the first packet
+// of the next lap.
+func (tracker *SessionTracker) endLap(packet Packet) {
+	lap := tracker.lap
+	session := tracker.session
+	tracker.lap = nil
+
+	// The game reports the time of the lap that was just completed, which is
+	// more accurate than the last current_lap_time that was received.
+	lapTime, ok := fieldFloat(packet, "last_lap_time")
+	if !ok || lapTime <= 0 {
+		lapTime = lap.lastCurrentTime
+	}
+	session.laps++
+	if session.bestLapTime == 0 || lapTime < session.bestLapTime {
+		session.bestLapTime = lapTime
+	}
+	tracker.writeLap(lap, lapTime, false)
+}
+
+// writeLap writes the summary of `lap`. Incomplete laps are marked with an
+// `incomplete` field.
+func (tracker *SessionTracker) writeLap(lap *lapSummary, lapTime float64, incomplete bool) {
+	fields := lap.stats.fields()
+	fields["lap_time"] = lapTime
+	if incomplete {
+		fields["incomplete"] = true
+	}
+	tracker.store.WritePacket(Packet{
+		Format:      lap.format,
+		Measurement: lapMeasurement,
+		Fields:      fields,
+		Tags: tracker.session.tags(map[string]string{
+			"lap_number": strconv.Itoa(lap.number),
+		}),
+		Timestamp: lap.start,
+	})
+}
+
+// End ends the session in progress, if any, e.g. when the server stops. The
+// lap in progress is written with the time driven so far, and is not counted
+// in the session's laps.
+func (tracker *SessionTracker) End() {
+	if tracker.session == nil {
+		return
+	}
+	if lap := tracker.lap; lap != nil {
+		tracker.writeLap(lap, lap.lastCurrentTime, true)
+	}
+	tracker.endSession()
+}
+
+// endSession writes the summary of the current session. Incomplete laps are
+// not written, except by End.
+func (tracker *SessionTracker) endSession() {
+	session := tracker.session
+	tracker.session = nil
+	tracker.lap = nil
+
+	fields := session.stats.fields()
+	fields["laps"] = session.laps
+	fields["duration"] = session.end.Sub(session.start).Seconds()
+	if session.laps > 0 {
+		fields["best_lap_time"] = session.bestLapTime
+	}
+	tracker.store.WritePacket(Packet{
+		Measurement: sessionMeasurement,
+		Fields:      fields,
+		Tags:        session.tags(map[string]string{}),
+		Timestamp:   session.start,
+	})
+}
+
+// tags adds the tags shared by the session's summaries to `tags`.
+func (session *sessionSummary) tags(tags map[string]string) map[string]string {
+	tags[sessionTag] = session.id
+	tags["car_id"] = session.carID
+	if session.driver != "" {
+		tags[driverTag] = session.driver
+	}
+	return tags
+}
+
+func (stats *drivingStats) add(packet Packet) {
+	if speed, ok := fieldFloat(packet, "speed"); ok && speed > stats.topSpeed {
+		stats.topSpeed = speed
+	}
+	if accel, ok := fieldFloat(packet, "accel"); ok {
+		stats.throttleTotal += accel / 255
+	}
+	if distance, ok := fieldFloat(packet, "distance_traveled"); ok {
+		if stats.samples == 0 {
+			stats.startDistance = distance
+		}
+		stats.lastDistance = distance
+	}
+	stats.samples++
+}
+
+func (stats *drivingStats) fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"top_speed": stats.topSpeed,
+		"distance":  stats.lastDistance - stats.startDistance,
+	}
+	if stats.samples > 0 {
+		fields["avg_throttle"] = stats.throttleTotal / float64(stats.samples)
+	}
+	return fields
+}
+
+// fieldFloat returns the numeric value of a field in the packet.
+func fieldFloat(packet Packet, label string) (float64, bool) {
+	return toFloat64(packet.Fields[label])
+}
+
+// tagInt returns the integer value of a tag in the packet.
+func tagInt(packet Packet, label string) (int, bool) {
+	value, ok := packet.Tags[label]
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(value)
+	return i, err == nil
+}
@@ -0,0 +1,91 @@
+package fh4server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStore is a PacketStore which sends every packet written to it to a
+// channel.
+type recordingStore struct {
+	packets chan Packet
+}
+
+func newRecordingStore() *recordingStore {
+	return &recordingStore{packets: make(chan Packet, 100)}
+}
+
+func (store *recordingStore) WritePacket(packet Packet) {
+	store.packets <- packet
+}
+
+func (store *recordingStore) next(r *require.Assertions) Packet {
+	select {
+	case packet := <-store.packets:
+		return packet
+	case <-time.After(time.Second):
+		r.FailNow("timed out waiting for packet")
+	}
+	return Packet{}
+}
+
+func trackerPacket(timestamp time.Time, raceOn bool, carID string, lap int, speed, lastLapTime, distance float32) Packet {
+	return Packet{
+		Timestamp:   timestamp,
+		Format:      FormatFH4,
+		Measurement: packetMeasurement,
+		IsRaceOn:    raceOn,
+		Fields: map[string]interface{}{
+			"speed":             speed,
+			"accel":             uint8(255),
+			"current_lap_time":  float32(1),
+			"last_lap_time":     lastLapTime,
+			"distance_traveled": distance,
+		},
+		Tags: map[string]string{
+			"car_id":     carID,
+			"lap_number": strconv.Itoa(lap),
+		},
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	r := require.New(t)
+	store := newRecordingStore()
+	tracker := NewSessionTracker(store)
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.Track(trackerPacket(start, false, "100", 0, 0, 0, 0))
+	first := trackerPacket(start.Add(time.Second), true, "100", 0, 10, 0, 0)
+	tracker.Track(first)
+	r.Equal("20190601T120001-100", first.Tags[sessionTag])
+	tracker.Track(trackerPacket(start.Add(2*time.Second), true, "100", 0, 30, 0, 500))
+	tracker.Track(trackerPacket(start.Add(3*time.Second), true, "100", 1, 20, 61.5, 1000))
+
+	lap := store.next(r)
+	r.Equal(lapMeasurement, lap.Measurement)
+	r.Equal("0", lap.Tags["lap_number"])
+	r.Equal(61.5, lap.Fields["lap_time"])
+	r.Equal(float64(30), lap.Fields["top_speed"])
+	r.Equal(float64(500), lap.Fields["distance"])
+	r.Equal(float64(1), lap.Fields["avg_throttle"])
+
+	// Changing cars ends the session and starts a new one.
+	tracker.Track(trackerPacket(start.Add(4*time.Second), true, "200", 0, 5, 0, 0))
+	session := store.next(r)
+	r.Equal(sessionMeasurement, session.Measurement)
+	r.Equal("20190601T120001-100", session.Tags[sessionTag])
+	r.Equal(1, session.Fields["laps"])
+	r.Equal(61.5, session.Fields["best_lap_time"])
+	r.Equal(float64(2), session.Fields["duration"])
+	r.Equal(float64(1000), session.Fields["distance"])
+
+	tracker.Track(trackerPacket(start.Add(5*time.Second), false, "200", 0, 0, 0, 0))
+	session = store.next(r)
+	r.Equal("20190601T120004-200", session.Tags[sessionTag])
+	r.Equal(0, session.Fields["laps"])
+	r.NotContains(session.Fields, "best_lap_time")
+}
@@ -1,8 +1,6 @@
 package fh4server
 
 import (
-	"time"
-
 	"github.com/golang/glog"
 )
 
@@ -21,11 +19,13 @@ func NewSimulatedDataStore(packetsToStore int) *SimulatedDataStore {
 }
 
 // WritePacket writes a packet to the database
-func (dataStore *SimulatedDataStore) WritePacket(packet Packet, timestamp time.Time) {
+func (dataStore *SimulatedDataStore) WritePacket(packet Packet) {
 	dataStore.packets = append(dataStore.packets, packet)
 	// trim down to max length
-	dataStore.packets = dataStore.packets[len(dataStore.packets)-dataStore.packetsToStore : len(dataStore.packets)]
+	if len(dataStore.packets) > dataStore.packetsToStore {
+		dataStore.packets = dataStore.packets[len(dataStore.packets)-dataStore.packetsToStore:]
+	}
 
-	glog.Infof("simulated writing packet at %s", timestamp)
+	glog.Infof("simulated writing packet at %s", packet.Timestamp)
 	glog.Infof("packet contents: %v", packet)
 }
@@ -2,49 +2,317 @@ package fh4server
 
 import (
 	"bytes"
-	"encoding/base64"
+	"flag"
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/golang/glog"
 )
 
-const (
-	fakePacket = "AQAAAHGpEAD2//lF+P9HREg17ETOUljBxAq0vp6jGk" +
-		"AHMB9BgzqMPgAOVj/faPM9fXSzv8Yygry3H/w/9+gKvWx7s7vyegc/NSD9P" +
-		"lpD7D7ZpEo/43IfQG+03z/mgKtAzkzePwZWCz8L5qFASKvOQXFkYUEAAAAA" +
-		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAJmZGT+ZmRk/mZkZP5mZGT8" +
-		"b06vAHRbewF+x7MBXmtjAWWu9QBYF5UDkJRJBbp7fQNDBPjzQQQg8IFO7O6" +
-		"QsFz0kBAAAAwAAACADAAACAAAABAAAACMAAAAAAAAAAAAAAJeqw8Lv3WtDx" +
-		"9qxxRPPH0EAAAAAAAAAAGVnm0LYSZpC/FaeQvxWnkLMdrLAAACAPwAAAAAA" +
-		"AAAAAAAAAAAAAABs2xdEAAAA/wAAAAGBAAAA"
+var (
+	simulatePacketRate = flag.Float64("simulate_packet_rate", 60, "number of packets per second sent by the simulated packet source.")
 )
 
 // SimulatedPacketSource implements PacketSource but does not have any external
-// dependencies and always sends an identical packet at a regular interval.
+// dependencies. It drives a virtual car around a closed track, and sends FH4
+// packets describing the car at a regular interval.
 //
-// Note: could add some randomization to the packet values in here, but
-// honestly this probably isn't going to be seeing much use now.
+// The physics are simple, but the values are self consistent: the car brakes
+// for corners and accelerates out of them, changes gear, completes laps, and
+// its tires heat up with slip. This makes it useful for exercising the parser,
+// lap tracking and dashboards without the game.
 type SimulatedPacketSource struct {
-	interval    time.Duration
-	packetBytes []byte
+	interval time.Duration
+	track    *simulatedTrack
+	car      simulatedCar
+	frame    TelemetryFrame
+}
+
+// NewSimulatedPacketSourceFromFlags sets up a SimulatedPacketSource which sends
+// packets at the rate given by -simulate_packet_rate.
+func NewSimulatedPacketSourceFromFlags() (*SimulatedPacketSource, error) {
+	if *simulatePacketRate <= 0 {
+		return nil, fmt.Errorf("-simulate_packet_rate must be positive, got %v", *simulatePacketRate)
+	}
+	return NewSimulatedPacketSource(time.Duration(float64(time.Second) / *simulatePacketRate)), nil
 }
 
-// NewSimulatedPacketSource sets up a SimulatedPacketSource to send the packet
+// NewSimulatedPacketSource sets up a SimulatedPacketSource to send a packet
 // at regular interval.
 func NewSimulatedPacketSource(interval time.Duration) *SimulatedPacketSource {
-	packetBytes, err := base64.StdEncoding.DecodeString(fakePacket)
-	if err != nil {
-		glog.Errorf("invalid input for fake packet source: %v", err)
-	}
+	track := newSimulatedTrack(600)
+	glog.Infof("simulating a %.0fm track", track.length)
 	return &SimulatedPacketSource{
-		interval:    interval,
-		packetBytes: packetBytes,
+		interval: interval,
+		track:    track,
+		car:      simulatedCar{tireTemp: [4]float64{ambientTireTemp, ambientTireTemp, ambientTireTemp, ambientTireTemp}},
 	}
 }
 
-// ReadNextPacket blocks for a period of time defined by `interval` before
-// returning the test packet.
-func (packetSource *SimulatedPacketSource) ReadNextPacket() *bytes.Buffer {
+// ReadNextPacket blocks for a period of time defined by `interval`, advances
+// the simulation by the same amount, and returns a packet describing the car.
+func (packetSource *SimulatedPacketSource) ReadNextPacket() (*bytes.Buffer, PacketMetadata, error) {
 	time.Sleep(packetSource.interval)
-	return bytes.NewBuffer(packetSource.packetBytes)
+	packetSource.car.step(packetSource.track, packetSource.interval.Seconds())
+	packetSource.car.fill(packetSource.track, &packetSource.frame)
+	packetBytes, err := Encode(packetSource.frame.Packet(AllowAll()))
+	if err != nil {
+		return nil, PacketMetadata{}, err
+	}
+	metadata := PacketMetadata{ReceiveTime: time.Now(), Length: len(packetBytes)}
+	return bytes.NewBuffer(packetBytes), metadata, nil
+}
+
+// Properties of the simulated car, roughly a 300kW rear wheel drive coupe.
+const (
+	carMass         = 1400.0 // kg
+	carMaxPower     = 300000 // W
+	carTopSpeed     = 75.0   // m/s
+	carMaxLateral   = 12.0   // m/s^2
+	carMaxBraking   = 10.0   // m/s^2
+	carWheelRadius  = 0.33   // m
+	carTrackWidth   = 1.6    // m
+	carWheelbase    = 2.6    // m
+	carMaxSteer     = 0.6    // radians
+	carFinalDrive   = 3.7
+	carIdleRPM      = 900.0
+	carMaxRPM       = 7500.0
+	carUpshiftRPM   = 6800.0
+	carMaxTorque    = 450.0 // Nm
+	ambientTireTemp = 80.0  // fahrenheit
+)
+
+var carGearRatios = []float64{3.5, 2.4, 1.8, 1.4, 1.15, 0.95}
+
+// simulatedTrack is a closed loop sampled at regular angles. Each sample holds
+// the position, heading and curvature of the track at that point, and the
+// highest speed the car can be going there while still making the corners
+// ahead.
+type simulatedTrack struct {
+	length float64
+	points []trackPoint
+}
+
+type trackPoint struct {
+	distance   float64 // from the start line, in meters
+	x, y, z    float64
+	heading    float64
+	curvature  float64
+	speedLimit float64
+}
+
+func newSimulatedTrack(radius float64) *simulatedTrack {
+	const samples = 2000
+	track := &simulatedTrack{points: make([]trackPoint, samples)}
+	for i := range track.points {
+		theta := 2 * math.Pi * float64(i) / samples
+		r := radius * (1 + 0.25*math.Sin(3*theta) + 0.1*math.Cos(5*theta))
+		track.points[i].x = r * math.Cos(theta)
+		track.points[i].z = r * math.Sin(theta)
+		track.points[i].y = 5 * math.Sin(2*theta)
+	}
+	for i := range track.points {
+		point, next := &track.points[i], track.points[(i+1)%samples]
+		point.heading = math.Atan2(next.z-point.z, next.x-point.x)
+		if i > 0 {
+			previous := track.points[i-1]
+			point.distance = previous.distance + math.Hypot(point.x-previous.x, point.z-previous.z)
+		}
+	}
+	last, first := track.points[samples-1], track.points[0]
+	track.length = last.distance + math.Hypot(first.x-last.x, first.z-last.z)
+
+	for i := range track.points {
+		point, next := &track.points[i], track.points[(i+1)%samples]
+		segment := math.Mod(next.distance-point.distance+track.length, track.length)
+		turn := math.Remainder(next.heading-point.heading, 2*math.Pi)
+		point.curvature = turn / segment
+		point.speedLimit = math.Min(carTopSpeed, math.Sqrt(carMaxLateral/math.Max(math.Abs(point.curvature), 1e-6)))
+	}
+	// Work backwards from each corner so that the car starts braking in
+	// time. Two passes are needed to carry the braking zones over the start
+	// line.
+	for pass := 0; pass < 2; pass++ {
+		for i := samples - 1; i >= 0; i-- {
+			point, next := &track.points[i], track.points[(i+1)%samples]
+			segment := math.Mod(next.distance-point.distance+track.length, track.length)
+			point.speedLimit = math.Min(point.speedLimit, math.Sqrt(next.speedLimit*next.speedLimit+2*carMaxBraking*segment))
+		}
+	}
+	return track
+}
+
+// at returns the track point at `distance` from the start line.
+func (track *simulatedTrack) at(distance float64) trackPoint {
+	i := int(distance / track.length * float64(len(track.points)))
+	return track.points[i%len(track.points)]
+}
+
+// simulatedCar holds the state of the simulated car.
+type simulatedCar struct {
+	elapsed      float64 // total simulated seconds
+	distance     float64 // around the current lap
+	odometer     float64
+	speed        float64
+	acceleration float64
+	throttle     float64
+	brake        float64
+	gear         int
+	rpm          float64
+
+	lap         int
+	lapTime     float64
+	lastLapTime float64
+	bestLapTime float64
+
+	slipRatio float64
+	slipAngle float64
+	tireTemp  [4]float64
+}
+
+// step advances the simulation by dt seconds.
+func (car *simulatedCar) step(track *simulatedTrack, dt float64) {
+	point := track.at(car.distance)
+
+	// Accelerate towards the speed limit, as hard as the engine and brakes
+	// allow.
+	maxAcceleration := carMaxPower/(carMass*math.Max(car.speed, 5)) - 0.0004*car.speed*car.speed
+	desired := (point.speedLimit - car.speed) / dt
+	car.acceleration = math.Max(-carMaxBraking, math.Min(desired, maxAcceleration))
+	car.throttle, car.brake = 0.15, 0
+	if car.acceleration > 0 {
+		car.throttle = math.Max(0.15, car.acceleration/maxAcceleration)
+	} else if car.acceleration < 0 {
+		car.throttle, car.brake = 0, -car.acceleration/carMaxBraking
+	}
+	car.speed = math.Max(0, car.speed+car.acceleration*dt)
+
+	car.elapsed += dt
+	car.lapTime += dt
+	car.distance += car.speed * dt
+	car.odometer += car.speed * dt
+	if car.distance >= track.length {
+		car.distance -= track.length
+		car.lap++
+		car.lastLapTime = car.lapTime
+		if car.bestLapTime == 0 || car.lapTime < car.bestLapTime {
+			car.bestLapTime = car.lapTime
+		}
+		car.lapTime = 0
+	}
+
+	// Use the highest gear that keeps the engine above its idle speed, and
+	// shift up before the redline.
+	wheelRPM := car.speed / carWheelRadius * 60 / (2 * math.Pi)
+	car.gear = 1
+	for car.gear < len(carGearRatios) && wheelRPM*carGearRatios[car.gear-1]*carFinalDrive > carUpshiftRPM {
+		car.gear++
+	}
+	car.rpm = math.Max(carIdleRPM, math.Min(carMaxRPM, wheelRPM*carGearRatios[car.gear-1]*carFinalDrive))
+
+	// Tires slip more the closer the car is to the limit of grip, and heat
+	// up as they slip.
+	lateral := car.speed * car.speed * point.curvature
+	car.slipAngle = lateral / carMaxLateral * 0.8
+	car.slipRatio = car.acceleration / carMaxBraking * 0.3
+	slip := math.Hypot(car.slipAngle, car.slipRatio)
+	for i := range car.tireTemp {
+		heating := 60 * slip * car.speed / carTopSpeed
+		car.tireTemp[i] += dt * (heating - 0.05*(car.tireTemp[i]-ambientTireTemp-100*slip))
+	}
+}
+
+// fill describes the car in a TelemetryFrame.
+func (car *simulatedCar) fill(track *simulatedTrack, frame *TelemetryFrame) {
+	point := track.at(car.distance)
+	lateral := car.speed * car.speed * point.curvature
+	steer := math.Atan(carWheelbase*point.curvature) / carMaxSteer
+	torque := carMaxTorque * (1 - 0.5*math.Pow((car.rpm-4500)/4500, 2)) * car.throttle
+	wheelSpeed := car.speed / carWheelRadius
+	inside, outside := 1-point.curvature*carTrackWidth/2, 1+point.curvature*carTrackWidth/2
+	slip := math.Hypot(car.slipAngle, car.slipRatio)
+
+	*frame = TelemetryFrame{
+		Format:           FormatFH4,
+		IsRaceOn:         1,
+		TimestampMs:      uint32(car.elapsed * 1000),
+		EngineMaxRPM:     carMaxRPM,
+		EngineIdleRPM:    carIdleRPM,
+		CurrentEngineRPM: float32(car.rpm),
+
+		AccelerationX: float32(lateral),
+		AccelerationZ: float32(car.acceleration),
+		VelocityZ:     float32(car.speed),
+
+		AngularVelocityY: float32(car.speed * point.curvature),
+		Yaw:              float32(point.heading),
+		Roll:             float32(-lateral / 50),
+		Pitch:            float32(-car.acceleration / 100),
+
+		NormalizedSuspensionTravelFrontLeft:  float32(0.5 + lateral/60 + car.acceleration/-80),
+		NormalizedSuspensionTravelFrontRight: float32(0.5 - lateral/60 + car.acceleration/-80),
+		NormalizedSuspensionTravelRearLeft:   float32(0.5 + lateral/60 + car.acceleration/80),
+		NormalizedSuspensionTravelRearRight:  float32(0.5 - lateral/60 + car.acceleration/80),
+
+		// The car is rear wheel drive, so only the rear wheels spin up.
+		TireSlipRatioFrontLeft:  float32(math.Min(car.slipRatio, 0)),
+		TireSlipRatioFrontRight: float32(math.Min(car.slipRatio, 0)),
+		TireSlipRatioRearLeft:   float32(car.slipRatio),
+		TireSlipRatioRearRight:  float32(car.slipRatio),
+
+		WheelRotationSpeedFrontLeft:  float32(wheelSpeed * inside),
+		WheelRotationSpeedFrontRight: float32(wheelSpeed * outside),
+		WheelRotationSpeedRearLeft:   float32(wheelSpeed * inside * (1 + car.slipRatio/10)),
+		WheelRotationSpeedRearRight:  float32(wheelSpeed * outside * (1 + car.slipRatio/10)),
+
+		TireSlipAngleFrontLeft:  float32(car.slipAngle),
+		TireSlipAngleFrontRight: float32(car.slipAngle),
+		TireSlipAngleRearLeft:   float32(car.slipAngle * 0.9),
+		TireSlipAngleRearRight:  float32(car.slipAngle * 0.9),
+
+		TireCombinedSlipFrontLeft:  float32(slip),
+		TireCombinedSlipFrontRight: float32(slip),
+		TireCombinedSlipRearLeft:   float32(slip),
+		TireCombinedSlipRearRight:  float32(slip),
+
+		SuspensionTravelMetersFrontLeft:  float32(0.05 + lateral/1200),
+		SuspensionTravelMetersFrontRight: float32(0.05 - lateral/1200),
+		SuspensionTravelMetersRearLeft:   float32(0.05 + lateral/1200),
+		SuspensionTravelMetersRearRight:  float32(0.05 - lateral/1200),
+
+		CarID:               1234,
+		CarClass:            5,
+		CarPerformanceIndex: 800,
+		DriveTrainType:      1,
+		NumEngineCylinders:  8,
+
+		PositionX: float32(point.x),
+		PositionY: float32(point.y),
+		PositionZ: float32(point.z),
+
+		Speed:  float32(car.speed),
+		Power:  float32(torque * car.rpm * 2 * math.Pi / 60),
+		Torque: float32(torque),
+
+		TireTempFrontLeft:  float32(car.tireTemp[0]),
+		TireTempFrontRight: float32(car.tireTemp[1]),
+		TireTempRearLeft:   float32(car.tireTemp[2]),
+		TireTempRearRight:  float32(car.tireTemp[3]),
+
+		Boost:            float32(car.throttle * 15),
+		Fuel:             float32(math.Max(0, 1-car.odometer/200000)),
+		DistanceTraveled: float32(car.odometer),
+		BestLapTime:      float32(car.bestLapTime),
+		LastLapTime:      float32(car.lastLapTime),
+		CurrentLapTime:   float32(car.lapTime),
+		CurrentRaceTime:  float32(car.elapsed),
+
+		LapNumber:    uint16(car.lap),
+		RacePosition: 1,
+		Accel:        uint8(car.throttle * 255),
+		Brake:        uint8(car.brake * 255),
+		Gear:         uint8(car.gear),
+		Steer:        int8(math.Max(-127, math.Min(127, steer*127))),
+	}
 }
@@ -0,0 +1,51 @@
+package fh4server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulatedPacketSourceDrivesLaps(t *testing.T) {
+	source := NewSimulatedPacketSource(0)
+	const dt = 1.0 / 60
+	for i := 0; i < 10*60*60; i++ {
+		source.car.step(source.track, dt)
+		if source.car.lap >= 2 {
+			break
+		}
+	}
+	require.Equal(t, 2, source.car.lap, "car should complete laps")
+	require.True(t, source.car.bestLapTime > 0)
+
+	buf, _, err := source.ReadNextPacket()
+	require.NoError(t, err)
+	require.Equal(t, fh4PacketSize, buf.Len())
+	packet, err := ParseBuf(bytes.NewBuffer(buf.Bytes()), AllowAll())
+	require.NoError(t, err)
+	require.True(t, packet.IsRaceOn)
+	require.Equal(t, FormatFH4, packet.Format)
+
+	var frame TelemetryFrame
+	require.NoError(t, DecodeTelemetryFrame(buf.Bytes(), &frame))
+	require.Equal(t, uint16(2), frame.LapNumber)
+	require.True(t, frame.Gear >= 1 && int(frame.Gear) <= len(carGearRatios))
+	require.True(t, frame.CurrentEngineRPM >= carIdleRPM && frame.CurrentEngineRPM <= carMaxRPM)
+	require.True(t, frame.TireTempFrontLeft > ambientTireTemp, "tires should warm up")
+	require.InDelta(t, frame.Speed, frame.VelocityZ, 0.001)
+}
+
+func TestSimulatedPacketSourceRate(t *testing.T) {
+	defer func(rate float64) { *simulatePacketRate = rate }(*simulatePacketRate)
+	for _, rate := range []float64{0, -60} {
+		*simulatePacketRate = rate
+		_, err := NewSimulatedPacketSourceFromFlags()
+		require.Error(t, err)
+	}
+	*simulatePacketRate = 120
+	source, err := NewSimulatedPacketSourceFromFlags()
+	require.NoError(t, err)
+	require.Equal(t, time.Second/120, source.interval)
+}
@@ -0,0 +1,278 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+var (
+	spoolDir         = flag.String("spool_dir", "", "when set, packets that can't be written to the db are spooled to disk in this directory and written once the db is available again.")
+	spoolSegmentSize = flag.Int64("spool_segment_size", 8<<20, "size in bytes at which a new spool segment file is started.")
+	spoolMaxSize     = flag.Int64("spool_max_size", 1<<30, "maximum size in bytes of the spool. The oldest segments are deleted to stay under this size.")
+)
+
+const spoolSegmentExt = ".spool"
+
+// DiskSpool is a durable first-in first-out queue of packet batches, stored
+// in a directory of segment files. Each segment holds a sequence of records,
+// each a little endian uint32 length followed by a gob encoded batch.
+//
+// Each batch is synced to disk before Append returns, so batches survive a
+// crash. A batch that can't be decoded is skipped rather than blocking the
+// batches after it.
+//
+// The read position within the oldest segment is only kept in memory, so after
+// a restart some batches may be replayed twice. This is harmless for InfluxDB,
+// which overwrites points with the same series and timestamp.
+type DiskSpool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu sync.Mutex
+	// segments are ordered from oldest to newest.
+	segments []*spoolSegment
+	// writer is open on the newest segment, or nil.
+	writer *os.File
+	// readOffset is the offset of the next record in the oldest segment.
+	readOffset int64
+	// nextSequence is used to name the next segment.
+	nextSequence uint64
+}
+
+type spoolSegment struct {
+	path string
+	size int64
+}
+
+// OpenDiskSpoolFromFlags opens the spool given by the -spool_* flags. It
+// returns nil if -spool_dir is not set.
+func OpenDiskSpoolFromFlags() (*DiskSpool, error) {
+	if *spoolDir == "" {
+		return nil, nil
+	}
+	return OpenDiskSpool(*spoolDir, *spoolSegmentSize, *spoolMaxSize)
+}
+
+// OpenDiskSpool opens, or creates, a spool in `dir`. Batches left in the spool
+// by a previous run are kept.
+func OpenDiskSpool(dir string, segmentSize, maxSize int64) (*DiskSpool, error) {
+	if segmentSize <= 0 || maxSize < segmentSize {
+		return nil, fmt.Errorf("spool segment size must be positive and no larger than the max size")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool dir: %v", err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool dir: %v", err)
+	}
+
+	spool := &DiskSpool{dir: dir, segmentSize: segmentSize, maxSize: maxSize}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), spoolSegmentExt) {
+			names = append(names, info.Name())
+		}
+	}
+	// Segment names are zero padded sequence numbers, so they sort in order.
+	sort.Strings(names)
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		spool.segments = append(spool.segments, &spoolSegment{path: filepath.Join(dir, name), size: info.Size()})
+		var sequence uint64
+		if _, err := fmt.Sscanf(name, "%d", &sequence); err == nil && sequence >= spool.nextSequence {
+			spool.nextSequence = sequence + 1
+		}
+	}
+	if len(spool.segments) > 0 {
+		glog.Infof("opened spool %s with %d segments to replay", dir, len(spool.segments))
+	}
+	return spool, nil
+}
+
+// Empty returns true if there are no batches in the spool.
+func (spool *DiskSpool) Empty() bool {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.empty()
+}
+
+func (spool *DiskSpool) empty() bool {
+	return len(spool.segments) == 0 ||
+		(len(spool.segments) == 1 && spool.readOffset >= spool.segments[0].size)
+}
+
+// Append adds a batch to the end of the spool.
+func (spool *DiskSpool) Append(packets []Packet) error {
+	var record bytes.Buffer
+	record.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&record).Encode(packets); err != nil {
+		return fmt.Errorf("failed to encode batch: %v", err)
+	}
+	recordBytes := record.Bytes()
+	binary.LittleEndian.PutUint32(recordBytes, uint32(len(recordBytes)-4))
+
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	if spool.writer == nil || spool.segments[len(spool.segments)-1].size >= spool.segmentSize {
+		if err := spool.startSegment(); err != nil {
+			return err
+		}
+	}
+	segment := spool.segments[len(spool.segments)-1]
+	n, err := spool.writer.Write(recordBytes)
+	segment.size += int64(n)
+	if err == nil {
+		err = spool.writer.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to spool: %v", err)
+	}
+	spool.enforceMaxSize()
+	return nil
+}
+
+// Peek returns the oldest batch in the spool without removing it. It returns
+// io.EOF if the spool is empty.
+func (spool *DiskSpool) Peek() ([]Packet, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	for !spool.empty() {
+		packets, _, err := spool.readRecord()
+		if err == io.EOF {
+			spool.removeOldestSegment()
+			continue
+		}
+		if err == io.ErrUnexpectedEOF {
+			// A partial record is left behind if the process was killed
+			// while appending. Nothing after it can be read.
+			glog.Warningf("skipping truncated record at the end of %s", spool.segments[0].path)
+			spool.removeOldestSegment()
+			continue
+		}
+		return packets, err
+	}
+	return nil, io.EOF
+}
+
+// Pop removes the oldest batch from the spool, including a batch that Peek
+// failed to decode.
+func (spool *DiskSpool) Pop() error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	if spool.empty() {
+		return io.EOF
+	}
+	_, size, err := spool.readRecord()
+	if size == 0 {
+		return err
+	}
+	spool.readOffset += size
+	if spool.readOffset >= spool.segments[0].size && len(spool.segments) > 1 {
+		spool.removeOldestSegment()
+	}
+	return nil
+}
+
+// Close closes the segment being written. Unread batches are kept on disk.
+func (spool *DiskSpool) Close() error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	if spool.writer == nil {
+		return nil
+	}
+	err := spool.writer.Close()
+	spool.writer = nil
+	return err
+}
+
+// readRecord reads the record at readOffset in the oldest segment, returning
+// the batch and the size of the record. The size is also returned if the
+// record was read but its batch could not be decoded, so it can be skipped.
+func (spool *DiskSpool) readRecord() ([]Packet, int64, error) {
+	file, err := os.Open(spool.segments[0].path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer file.Close()
+
+	reader := io.NewSectionReader(file, spool.readOffset, spool.segments[0].size-spool.readOffset)
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	var packets []Packet
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&packets); err != nil {
+		return nil, int64(len(header) + len(body)), fmt.Errorf("failed to decode spooled batch: %v", err)
+	}
+	return packets, int64(len(header) + len(body)), nil
+}
+
+func (spool *DiskSpool) startSegment() error {
+	if spool.writer != nil {
+		if err := spool.writer.Close(); err != nil {
+			return err
+		}
+		spool.writer = nil
+	}
+	path := filepath.Join(spool.dir, fmt.Sprintf("%020d%s", spool.nextSequence, spoolSegmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %v", err)
+	}
+	spool.nextSequence++
+	spool.writer = file
+	spool.segments = append(spool.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// enforceMaxSize deletes the oldest segments until the spool fits in maxSize.
+// The segment being written is never deleted.
+func (spool *DiskSpool) enforceMaxSize() {
+	var total int64
+	for _, segment := range spool.segments {
+		total += segment.size
+	}
+	for total > spool.maxSize && len(spool.segments) > 1 {
+		glog.Errorf("spool is full, discarding %s", spool.segments[0].path)
+		total -= spool.segments[0].size
+		spool.removeOldestSegment()
+	}
+}
+
+func (spool *DiskSpool) removeOldestSegment() {
+	oldest := spool.segments[0]
+	if len(spool.segments) == 1 && spool.writer != nil {
+		spool.writer.Close()
+		spool.writer = nil
+	}
+	if err := os.Remove(oldest.path); err != nil {
+		glog.Warningf("failed to remove spool segment: %v", err)
+	}
+	spool.segments = spool.segments[1:]
+	spool.readOffset = 0
+}
@@ -0,0 +1,140 @@
+package fh4server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func spoolBatch(values ...float32) []Packet {
+	batch := make([]Packet, 0, len(values))
+	for _, value := range values {
+		batch = append(batch, Packet{
+			Measurement: packetMeasurement,
+			Fields:      map[string]interface{}{"speed": value, "gear": uint8(3), "on_rumble_strip_front_left": true},
+			Tags:        map[string]string{"car_id": "100"},
+			Timestamp:   time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+		})
+	}
+	return batch
+}
+
+func TestDiskSpool(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenDiskSpool(dir, 100, 1<<20)
+	r.NoError(err)
+	r.True(spool.Empty())
+	for i := 0; i < 5; i++ {
+		r.NoError(spool.Append(spoolBatch(float32(i))))
+	}
+	r.False(spool.Empty())
+
+	// Types are preserved, so that fields keep their type in the store.
+	batch, err := spool.Peek()
+	r.NoError(err)
+	r.Equal(spoolBatch(0), batch)
+	r.NoError(spool.Pop())
+	r.NoError(spool.Close())
+
+	// Unread batches survive a restart. The read position does not, so the
+	// popped batch is read again if its segment was not finished.
+	spool, err = OpenDiskSpool(dir, 100, 1<<20)
+	r.NoError(err)
+	var speeds []interface{}
+	for {
+		batch, err := spool.Peek()
+		if err == io.EOF {
+			break
+		}
+		r.NoError(err)
+		speeds = append(speeds, batch[0].Fields["speed"])
+		r.NoError(spool.Pop())
+	}
+	r.Equal([]interface{}{float32(1), float32(2), float32(3), float32(4)}, speeds[len(speeds)-4:])
+	r.True(spool.Empty())
+	r.NoError(spool.Close())
+}
+
+func TestDiskSpoolMaxSize(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenDiskSpool(dir, 100, 300)
+	r.NoError(err)
+	defer spool.Close()
+	for i := 0; i < 20; i++ {
+		r.NoError(spool.Append(spoolBatch(float32(i))))
+	}
+	batch, err := spool.Peek()
+	r.NoError(err)
+	r.NotEqual(float32(0), batch[0].Fields["speed"])
+}
+
+func TestDiskSpoolCorruptRecord(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	// A complete record whose body isn't a gob encoded batch.
+	r.NoError(ioutil.WriteFile(filepath.Join(dir, "00000000000000000000.spool"), []byte{4, 0, 0, 0, 'j', 'u', 'n', 'k'}, 0644))
+
+	spool, err := OpenDiskSpool(dir, 1<<20, 1<<20)
+	r.NoError(err)
+	defer spool.Close()
+	r.NoError(spool.Append(spoolBatch(1)))
+	_, err = spool.Peek()
+	r.Error(err)
+	// The bad record is skipped, rather than blocking the batches after it.
+	r.NoError(spool.Pop())
+	batch, err := spool.Peek()
+	r.NoError(err)
+	r.Equal(spoolBatch(1), batch)
+	r.NoError(spool.Pop())
+	r.True(spool.Empty())
+}
+
+func TestBatchingStoreReplaysSpool(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	spool, err := OpenDiskSpool(dir, 1<<20, 1<<20)
+	r.NoError(err)
+	defer spool.Close()
+
+	backend := &flakyBatchStore{failures: 3}
+	options := testBatchOptions()
+	options.Size = 1
+	options.MaxRetries = 0
+	options.Interval = 10 * time.Millisecond
+	options.Spool = spool
+	store, err := NewBatchingStore(backend, options)
+	r.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		store.WritePacket(spoolBatch(float32(i))[0])
+	}
+	for deadline := time.Now().Add(time.Second); store.Stats().Written < 3; {
+		r.True(time.Now().Before(deadline), "spool was not replayed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.Close()
+
+	r.Len(backend.batches, 3)
+	for i, batch := range backend.batches {
+		r.Equal(float32(i), batch[0].Fields["speed"])
+	}
+	r.Equal(uint64(3), store.Stats().Spooled)
+	r.True(spool.Empty())
+}
@@ -0,0 +1,376 @@
+package fh4server
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	// Registers the "sqlite" database/sql driver, which needs no cgo.
+	_ "modernc.org/sqlite"
+)
+
+var (
+	sqliteRetention = flag.Duration("sqlite_retention", 0, "with -store=sqlite:<path>, samples, laps and sessions older than this are deleted, e.g. 720h. 0 keeps everything.")
+)
+
+// sqlitePruneInterval is how often a SQLiteStore deletes data older than its
+// retention.
+const sqlitePruneInterval = 10 * time.Minute
+
+// sqliteTypes are the column types used for each type of field value.
+var sqliteTypes = map[reflect.Kind]string{
+	reflect.Bool:    "INTEGER",
+	reflect.Int8:    "INTEGER",
+	reflect.Uint8:   "INTEGER",
+	reflect.Int16:   "INTEGER",
+	reflect.Uint16:  "INTEGER",
+	reflect.Int32:   "INTEGER",
+	reflect.Int:     "INTEGER",
+	reflect.Uint32:  "INTEGER",
+	reflect.Int64:   "INTEGER",
+	reflect.Float32: "REAL",
+	reflect.Float64: "REAL",
+	reflect.String:  "TEXT",
+}
+
+// sqliteSchema creates the tables of a SQLiteStore, apart from the columns of
+// samples, which come from the packet definition. Times are stored as
+// fractional seconds since the unix epoch, so that e.g.
+// datetime(start_time, 'unixepoch') works.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		session_id TEXT PRIMARY KEY,
+		car_id TEXT,
+		driver TEXT,
+		source_ip TEXT,
+		start_time REAL NOT NULL,
+		end_time REAL,
+		laps INTEGER,
+		duration REAL,
+		best_lap_time REAL,
+		top_speed REAL,
+		distance REAL,
+		avg_throttle REAL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_start_time_idx ON sessions (start_time)`,
+	`CREATE TABLE IF NOT EXISTS laps (
+		session_id TEXT NOT NULL,
+		lap_number INTEGER NOT NULL,
+		car_id TEXT,
+		driver TEXT,
+		start_time REAL NOT NULL,
+		lap_time REAL,
+		top_speed REAL,
+		distance REAL,
+		avg_throttle REAL,
+		PRIMARY KEY (session_id, lap_number)
+	)`,
+	`CREATE INDEX IF NOT EXISTS laps_start_time_idx ON laps (start_time)`,
+	`CREATE TABLE IF NOT EXISTS samples (time REAL NOT NULL, extra TEXT)`,
+}
+
+// SQLiteStore implements PacketStore and BatchPacketStore by writing to a
+// single SQLite file, so no database server is needed.
+//
+// Packets are written to the samples table, which has a column for every field
+// and tag in the packet definition, like PostgresStore. Fields and tags
+// without a column are kept as JSON in the extra column. Lap and session
+// summaries are written to the laps and sessions tables, and every session
+// gets a row in sessions as soon as its first sample is written.
+//
+// Each batch is written in one transaction. When a retention is set, older
+// data is deleted every few minutes.
+type SQLiteStore struct {
+	db        *sql.DB
+	columns   []packetColumn
+	retention time.Duration
+
+	// insertSample is the statement which writes a row of samples.
+	insertSample string
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	// lastErr is the error returned by the most recent write.
+	lastErr error
+}
+
+// NewSQLiteStore opens, or creates, the SQLite file at `path` and sets up its
+// tables. The packet definition must be loaded first, so that every element
+// has a column. Data older than `retention` is deleted, unless it is 0.
+func NewSQLiteStore(path string, retention time.Duration) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	// Pragmas apply to a connection, and SQLite only has one writer anyway.
+	db.SetMaxOpenConns(1)
+	store := &SQLiteStore{db: db, retention: retention}
+	for _, column := range packetColumns() {
+		if _, ok := sqliteTypes[column.kind]; ok {
+			store.columns = append(store.columns, column)
+		}
+	}
+	if err := store.createTables(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up %s: %v", path, err)
+	}
+
+	names := []string{"time", "extra"}
+	for _, column := range store.columns {
+		names = append(names, sqliteQuote(column.name))
+	}
+	store.insertSample = fmt.Sprintf("INSERT INTO samples (%s) VALUES (?%s)", strings.Join(names, ", "), strings.Repeat(", ?", len(names)-1))
+
+	if err := store.prune(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	glog.Infof("writing packets to %s", path)
+	return store, nil
+}
+
+// createTables creates the tables, and adds a column to samples for each
+// element it is missing.
+func (store *SQLiteStore) createTables() error {
+	for _, statement := range []string{
+		// auto_vacuum only takes effect when the file is created, it lets
+		// the file shrink after old data is deleted.
+		"PRAGMA auto_vacuum = INCREMENTAL",
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+	} {
+		if _, err := store.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	for _, statement := range sqliteSchema {
+		if _, err := store.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	rows, err := store.db.Query("PRAGMA table_info(samples)")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue interface{}
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, column := range store.columns {
+		// SQLite column names are case insensitive.
+		if existing[strings.ToLower(column.name)] {
+			continue
+		}
+		statement := fmt.Sprintf("ALTER TABLE samples ADD COLUMN %s %s", sqliteQuote(column.name), sqliteTypes[column.kind])
+		if _, err := store.db.Exec(statement); err != nil {
+			return err
+		}
+		existing[strings.ToLower(column.name)] = true
+	}
+	for _, statement := range []string{
+		`CREATE INDEX IF NOT EXISTS samples_time_idx ON samples (time)`,
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS samples_session_idx ON samples (%s, time)`, sqliteQuote(sessionTag)),
+	} {
+		if _, err := store.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close should be called when the database is no longer needed.
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+// WritePacket writes a packet to the database.
+func (store *SQLiteStore) WritePacket(packet Packet) {
+	if err := store.WritePackets([]Packet{packet}); err != nil {
+		glog.Warningf("failed to write packet to sqlite: %v", err)
+	}
+}
+
+// WritePackets writes a batch of packets to the database in a single
+// transaction.
+func (store *SQLiteStore) WritePackets(packets []Packet) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	err := store.writePackets(packets)
+	if err == nil && store.retention > 0 && time.Since(store.lastPrune) >= sqlitePruneInterval {
+		err = store.prune(time.Now())
+	}
+	store.lastErr = err
+	return err
+}
+
+func (store *SQLiteStore) writePackets(packets []Packet) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, packet := range packets {
+		switch packet.Measurement {
+		case "", packetMeasurement:
+			err = store.writeSample(tx, packet)
+		case lapMeasurement:
+			err = writeLap(tx, packet)
+		case sessionMeasurement:
+			err = writeSession(tx, packet)
+		default:
+			glog.V(1).Infof("not writing %s packet to sqlite", packet.Measurement)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) writeSample(tx *sql.Tx, packet Packet) error {
+	values, extra := finiteColumnValues(packet, store.columns)
+	for i, value := range values {
+		values[i] = sqliteValue(value)
+	}
+	args := append([]interface{}{sqliteTime(packet.Timestamp), extra}, values...)
+	if _, err := tx.Exec(store.insertSample, args...); err != nil {
+		return fmt.Errorf("failed to write sample: %v", err)
+	}
+	if sessionID, ok := packet.Tags[sessionTag]; ok {
+		_, err := tx.Exec(`INSERT INTO sessions (session_id, car_id, driver, source_ip, start_time) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (session_id) DO NOTHING`,
+			sessionID, packet.Tags["car_id"], packet.Tags[driverTag], packet.Tags[sourceTag], sqliteTime(packet.Timestamp))
+		if err != nil {
+			return fmt.Errorf("failed to write session: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeLap(tx *sql.Tx, packet Packet) error {
+	lapNumber, ok := tagInt(packet, "lap_number")
+	if !ok {
+		return nil
+	}
+	// The lap in progress when a session is cut short has no lap time.
+	lapTime := summaryField(packet, "lap_time")
+	if incomplete, _ := packet.Fields["incomplete"].(bool); incomplete {
+		lapTime = nil
+	}
+	_, err := tx.Exec(`INSERT OR REPLACE INTO laps (session_id, lap_number, car_id, driver, start_time, lap_time, top_speed, distance, avg_throttle)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		packet.Tags[sessionTag], lapNumber, packet.Tags["car_id"], packet.Tags[driverTag], sqliteTime(packet.Timestamp),
+		lapTime, summaryField(packet, "top_speed"), summaryField(packet, "distance"), summaryField(packet, "avg_throttle"))
+	if err != nil {
+		return fmt.Errorf("failed to write lap: %v", err)
+	}
+	return nil
+}
+
+func writeSession(tx *sql.Tx, packet Packet) error {
+	var endTime interface{}
+	if duration, ok := fieldFloat(packet, "duration"); ok {
+		endTime = sqliteTime(packet.Timestamp) + duration
+	}
+	_, err := tx.Exec(`INSERT INTO sessions (session_id, car_id, driver, start_time, end_time, laps, duration, best_lap_time, top_speed, distance, avg_throttle)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET
+			car_id = excluded.car_id, driver = excluded.driver, start_time = excluded.start_time, end_time = excluded.end_time,
+			laps = excluded.laps, duration = excluded.duration, best_lap_time = excluded.best_lap_time,
+			top_speed = excluded.top_speed, distance = excluded.distance, avg_throttle = excluded.avg_throttle`,
+		packet.Tags[sessionTag], packet.Tags["car_id"], packet.Tags[driverTag], sqliteTime(packet.Timestamp), endTime,
+		summaryField(packet, "laps"), summaryField(packet, "duration"), summaryField(packet, "best_lap_time"),
+		summaryField(packet, "top_speed"), summaryField(packet, "distance"), summaryField(packet, "avg_throttle"))
+	if err != nil {
+		return fmt.Errorf("failed to write session: %v", err)
+	}
+	return nil
+}
+
+// prune deletes the data older than the retention, and returns the space it
+// used to the file system.
+func (store *SQLiteStore) prune(now time.Time) error {
+	store.lastPrune = now
+	if store.retention <= 0 {
+		return nil
+	}
+	cutoff := sqliteTime(now.Add(-store.retention))
+	var deleted int64
+	for _, statement := range []string{
+		"DELETE FROM samples WHERE time < ?",
+		"DELETE FROM laps WHERE start_time < ?",
+		"DELETE FROM sessions WHERE coalesce(end_time, start_time) < ?",
+	} {
+		result, err := store.db.Exec(statement, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to delete old data: %v", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+	if deleted > 0 {
+		glog.Infof("deleted %d rows older than %v", deleted, store.retention)
+		if _, err := store.db.Exec("PRAGMA incremental_vacuum"); err != nil {
+			glog.Warningf("failed to shrink sqlite file: %v", err)
+		}
+	}
+	return nil
+}
+
+// Healthy returns the error of the most recent write, if it failed.
+func (store *SQLiteStore) Healthy() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lastErr != nil {
+		return fmt.Errorf("last write failed: %v", store.lastErr)
+	}
+	return nil
+}
+
+// sqliteTime returns the time in fractional seconds since the unix epoch.
+func sqliteTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// sqliteValue converts float32s to the float64 with the same decimal
+// representation, rather than its exact value, so that e.g. 0.1 is stored as
+// 0.1 rather than 0.10000000149011612.
+func sqliteValue(value interface{}) interface{} {
+	if f, ok := value.(float32); ok {
+		converted, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+		return converted
+	}
+	return value
+}
+
+// summaryField returns the numeric value of a summary field, or nil if the
+// summary does not have it.
+func summaryField(packet Packet, label string) interface{} {
+	if value, ok := fieldFloat(packet, label); ok {
+		return value
+	}
+	return nil
+}
+
+// sqliteQuote quotes an identifier.
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,96 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "sqlite")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "telemetry.db")
+
+	store, err := NewSQLiteStore(path, 0)
+	r.NoError(err)
+	packetBytes, err := base64.StdEncoding.DecodeString(testPacket)
+	r.NoError(err)
+	packet, err := ParseBuf(bytes.NewBuffer(packetBytes), AllowAll())
+	r.NoError(err)
+	start := time.Unix(1559390400, 0)
+	packet.Timestamp = start
+	packet.Tags[sessionTag] = "20190601T120000-1234"
+	packet.Tags[sourceTag] = "192.168.1.20"
+	packet.Fields["unknown"] = float32(0.1)
+
+	lapTags := map[string]string{sessionTag: "20190601T120000-1234", "car_id": "1234", "lap_number": "0"}
+	r.NoError(store.WritePackets([]Packet{
+		packet,
+		{Measurement: lapMeasurement, Fields: map[string]interface{}{"lap_time": 60.5, "top_speed": 50.0}, Tags: lapTags, Timestamp: start},
+		{Measurement: sessionMeasurement, Fields: map[string]interface{}{"laps": 1, "duration": 61.0, "best_lap_time": 60.5}, Tags: map[string]string{sessionTag: "20190601T120000-1234", "car_id": "1234"}, Timestamp: start},
+	}))
+	r.NoError(store.Healthy())
+	r.NoError(store.Close())
+
+	// Reopening the file keeps what was written.
+	store, err = NewSQLiteStore(path, 0)
+	r.NoError(err)
+	defer store.Close()
+
+	var sampleTime float64
+	var speed float64
+	var carID, sourceIP, extra string
+	r.NoError(store.db.QueryRow(`SELECT time, speed, car_id, source_ip, extra FROM samples`).Scan(&sampleTime, &speed, &carID, &sourceIP, &extra))
+	r.Equal(float64(1559390400), sampleTime)
+	r.Equal(float64(packet.Fields["speed"].(float32)), float64(float32(speed)))
+	r.Equal(packet.Tags["car_id"], carID)
+	r.Equal("192.168.1.20", sourceIP)
+	r.JSONEq(`{"fields":{"unknown":0.1}}`, extra)
+
+	var lapTime, topSpeed float64
+	r.NoError(store.db.QueryRow(`SELECT lap_time, top_speed FROM laps WHERE session_id = ? AND lap_number = 0`, "20190601T120000-1234").Scan(&lapTime, &topSpeed))
+	r.Equal(60.5, lapTime)
+	r.Equal(50.0, topSpeed)
+
+	// The session row added with the first sample was completed by the
+	// session summary.
+	var laps int
+	var endTime float64
+	var sessionSource string
+	r.NoError(store.db.QueryRow(`SELECT laps, end_time, source_ip FROM sessions WHERE session_id = ?`, "20190601T120000-1234").Scan(&laps, &endTime, &sessionSource))
+	r.Equal(1, laps)
+	r.Equal(float64(1559390461), endTime)
+	r.Equal("192.168.1.20", sessionSource)
+}
+
+func TestSQLiteStoreRetention(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "sqlite")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewSQLiteStore(filepath.Join(dir, "telemetry.db"), time.Hour)
+	r.NoError(err)
+	defer store.Close()
+
+	now := time.Now()
+	sample := func(timestamp time.Time) Packet {
+		return Packet{Measurement: packetMeasurement, Fields: map[string]interface{}{"speed": float32(1)}, Tags: map[string]string{sessionTag: timestamp.String()}, Timestamp: timestamp}
+	}
+	r.NoError(store.WritePackets([]Packet{sample(now.Add(-2 * time.Hour)), sample(now.Add(-time.Minute))}))
+	r.NoError(store.prune(now))
+
+	var samples, sessions int
+	r.NoError(store.db.QueryRow(`SELECT count(*) FROM samples`).Scan(&samples))
+	r.NoError(store.db.QueryRow(`SELECT count(*) FROM sessions`).Scan(&sessions))
+	r.Equal(1, samples)
+	r.Equal(1, sessions)
+}
@@ -0,0 +1,465 @@
+package fh4server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// TelemetryFrame holds the raw values of every element of a packet, decoded
+// directly from the packet bytes without any allocations. The fields are in
+// the order of the elements of the built in packet layouts.
+//
+// TelemetryFrame always uses the built in packet layouts, so it is unaffected
+// by -packet_definition. To encode a frame, pass frame.Packet to Encode.
+type TelemetryFrame struct {
+	// Format is the name of the packet format the frame was decoded from.
+	Format string
+
+	// Sled data, sent by every format.
+	IsRaceOn                             int32
+	TimestampMs                          uint32
+	EngineMaxRPM                         float32
+	EngineIdleRPM                        float32
+	CurrentEngineRPM                     float32
+	AccelerationX                        float32
+	AccelerationY                        float32
+	AccelerationZ                        float32
+	VelocityX                            float32
+	VelocityY                            float32
+	VelocityZ                            float32
+	AngularVelocityX                     float32
+	AngularVelocityY                     float32
+	AngularVelocityZ                     float32
+	Yaw                                  float32
+	Pitch                                float32
+	Roll                                 float32
+	NormalizedSuspensionTravelFrontLeft  float32
+	NormalizedSuspensionTravelFrontRight float32
+	NormalizedSuspensionTravelRearLeft   float32
+	NormalizedSuspensionTravelRearRight  float32
+	TireSlipRatioFrontLeft               float32
+	TireSlipRatioFrontRight              float32
+	TireSlipRatioRearLeft                float32
+	TireSlipRatioRearRight               float32
+	WheelRotationSpeedFrontLeft          float32
+	WheelRotationSpeedFrontRight         float32
+	WheelRotationSpeedRearLeft           float32
+	WheelRotationSpeedRearRight          float32
+	OnRumbleStripFrontLeft               int32
+	OnRumbleStripFrontRight              int32
+	OnRumbleStripRearLeft                int32
+	OnRumbleStripRearRight               int32
+	PuddleDepthFrontLeft                 float32
+	PuddleDepthFrontRight                float32
+	PuddleDepthRearLeft                  float32
+	PuddleDepthRearRight                 float32
+	SurfaceRumbleFrontLeft               float32
+	SurfaceRumbleFrontRight              float32
+	SurfaceRumbleRearLeft                float32
+	SurfaceRumbleRearRight               float32
+	TireSlipAngleFrontLeft               float32
+	TireSlipAngleFrontRight              float32
+	TireSlipAngleRearLeft                float32
+	TireSlipAngleRearRight               float32
+	TireCombinedSlipFrontLeft            float32
+	TireCombinedSlipFrontRight           float32
+	TireCombinedSlipRearLeft             float32
+	TireCombinedSlipRearRight            float32
+	SuspensionTravelMetersFrontLeft      float32
+	SuspensionTravelMetersFrontRight     float32
+	SuspensionTravelMetersRearLeft       float32
+	SuspensionTravelMetersRearRight      float32
+	CarID                                int32
+	CarClass                             int32
+	CarPerformanceIndex                  int32
+	DriveTrainType                       int32
+	NumEngineCylinders                   int32
+
+	// Dash data, not sent in the FormatFM7Sled format.
+	PositionX                   float32
+	PositionY                   float32
+	PositionZ                   float32
+	Speed                       float32
+	Power                       float32
+	Torque                      float32
+	TireTempFrontRight          float32
+	TireTempFrontLeft           float32
+	TireTempRearLeft            float32
+	TireTempRearRight           float32
+	Boost                       float32
+	Fuel                        float32
+	DistanceTraveled            float32
+	BestLapTime                 float32
+	LastLapTime                 float32
+	CurrentLapTime              float32
+	CurrentRaceTime             float32
+	LapNumber                   uint16
+	RacePosition                uint8
+	Accel                       uint8
+	Brake                       uint8
+	Clutch                      uint8
+	HandBrake                   uint8
+	Gear                        uint8
+	Steer                       int8
+	NormalizedDrivingLine       int8
+	NormalizedAIBrakeDifference int8
+
+	// values is reused by Packet for the frame's values.
+	values []interface{}
+}
+
+// Sizes of the built in packet formats.
+const (
+	fm7SledPacketSize = 232
+	fm7DashPacketSize = 311
+	fh4PacketSize     = 324
+
+	// fh4DashOffset is where the dash data starts in FH4 packets.
+	fh4DashOffset = 244
+)
+
+// DecodeTelemetryFrame decodes `data` into `frame`. The format of the packet is
+// detected from its length. Values not present in the packet's format are set
+// to zero.
+func DecodeTelemetryFrame(data []byte, frame *TelemetryFrame) error {
+	var format string
+	var dashOffset int
+	switch len(data) {
+	case fm7SledPacketSize:
+		format = FormatFM7Sled
+	case fm7DashPacketSize:
+		format = FormatFM7Dash
+		dashOffset = fm7SledPacketSize
+	case fh4PacketSize:
+		format = FormatFH4
+		dashOffset = fh4DashOffset
+	default:
+		if len(data) < fm7SledPacketSize {
+			return fmt.Errorf("%w (%d bytes, expected at least %d)", ErrShortPacket, len(data), fm7SledPacketSize)
+		}
+		return fmt.Errorf("%w (%d bytes)", ErrUnknownFormat, len(data))
+	}
+
+	*frame = TelemetryFrame{Format: format, values: frame.values}
+	frame.decodeSled(frameReader{data: data})
+	if dashOffset != 0 {
+		frame.decodeDash(frameReader{data: data, offset: dashOffset})
+	}
+	return nil
+}
+
+func (frame *TelemetryFrame) decodeSled(r frameReader) {
+	frame.IsRaceOn = r.s32()
+	frame.TimestampMs = r.u32()
+	frame.EngineMaxRPM = r.f32()
+	frame.EngineIdleRPM = r.f32()
+	frame.CurrentEngineRPM = r.f32()
+	frame.AccelerationX = r.f32()
+	frame.AccelerationY = r.f32()
+	frame.AccelerationZ = r.f32()
+	frame.VelocityX = r.f32()
+	frame.VelocityY = r.f32()
+	frame.VelocityZ = r.f32()
+	frame.AngularVelocityX = r.f32()
+	frame.AngularVelocityY = r.f32()
+	frame.AngularVelocityZ = r.f32()
+	frame.Yaw = r.f32()
+	frame.Pitch = r.f32()
+	frame.Roll = r.f32()
+	frame.NormalizedSuspensionTravelFrontLeft = r.f32()
+	frame.NormalizedSuspensionTravelFrontRight = r.f32()
+	frame.NormalizedSuspensionTravelRearLeft = r.f32()
+	frame.NormalizedSuspensionTravelRearRight = r.f32()
+	frame.TireSlipRatioFrontLeft = r.f32()
+	frame.TireSlipRatioFrontRight = r.f32()
+	frame.TireSlipRatioRearLeft = r.f32()
+	frame.TireSlipRatioRearRight = r.f32()
+	frame.WheelRotationSpeedFrontLeft = r.f32()
+	frame.WheelRotationSpeedFrontRight = r.f32()
+	frame.WheelRotationSpeedRearLeft = r.f32()
+	frame.WheelRotationSpeedRearRight = r.f32()
+	frame.OnRumbleStripFrontLeft = r.s32()
+	frame.OnRumbleStripFrontRight = r.s32()
+	frame.OnRumbleStripRearLeft = r.s32()
+	frame.OnRumbleStripRearRight = r.s32()
+	frame.PuddleDepthFrontLeft = r.f32()
+	frame.PuddleDepthFrontRight = r.f32()
+	frame.PuddleDepthRearLeft = r.f32()
+	frame.PuddleDepthRearRight = r.f32()
+	frame.SurfaceRumbleFrontLeft = r.f32()
+	frame.SurfaceRumbleFrontRight = r.f32()
+	frame.SurfaceRumbleRearLeft = r.f32()
+	frame.SurfaceRumbleRearRight = r.f32()
+	frame.TireSlipAngleFrontLeft = r.f32()
+	frame.TireSlipAngleFrontRight = r.f32()
+	frame.TireSlipAngleRearLeft = r.f32()
+	frame.TireSlipAngleRearRight = r.f32()
+	frame.TireCombinedSlipFrontLeft = r.f32()
+	frame.TireCombinedSlipFrontRight = r.f32()
+	frame.TireCombinedSlipRearLeft = r.f32()
+	frame.TireCombinedSlipRearRight = r.f32()
+	frame.SuspensionTravelMetersFrontLeft = r.f32()
+	frame.SuspensionTravelMetersFrontRight = r.f32()
+	frame.SuspensionTravelMetersRearLeft = r.f32()
+	frame.SuspensionTravelMetersRearRight = r.f32()
+	frame.CarID = r.s32()
+	frame.CarClass = r.s32()
+	frame.CarPerformanceIndex = r.s32()
+	frame.DriveTrainType = r.s32()
+	frame.NumEngineCylinders = r.s32()
+}
+
+func (frame *TelemetryFrame) decodeDash(r frameReader) {
+	frame.PositionX = r.f32()
+	frame.PositionY = r.f32()
+	frame.PositionZ = r.f32()
+	frame.Speed = r.f32()
+	frame.Power = r.f32()
+	frame.Torque = r.f32()
+	frame.TireTempFrontRight = r.f32()
+	frame.TireTempFrontLeft = r.f32()
+	frame.TireTempRearLeft = r.f32()
+	frame.TireTempRearRight = r.f32()
+	frame.Boost = r.f32()
+	frame.Fuel = r.f32()
+	frame.DistanceTraveled = r.f32()
+	frame.BestLapTime = r.f32()
+	frame.LastLapTime = r.f32()
+	frame.CurrentLapTime = r.f32()
+	frame.CurrentRaceTime = r.f32()
+	frame.LapNumber = r.u16()
+	frame.RacePosition = r.u8()
+	frame.Accel = r.u8()
+	frame.Brake = r.u8()
+	frame.Clutch = r.u8()
+	frame.HandBrake = r.u8()
+	frame.Gear = r.u8()
+	frame.Steer = r.s8()
+	frame.NormalizedDrivingLine = r.s8()
+	frame.NormalizedAIBrakeDifference = r.s8()
+}
+
+// Packet converts the frame into a Packet, in the same way that ParseBuf would
+// have parsed the original packet with the built in packet layouts. The
+// values still have to be boxed into the packet's maps, so this allocates for
+// each value.
+func (frame *TelemetryFrame) Packet(whitelist Whitelist) Packet {
+	format, ok := telemetryFrameFormats[frame.Format]
+	if !ok {
+		// The frame's values don't line up with the format's elements.
+		panic(fmt.Sprintf("TelemetryFrame can't convert %q packets", frame.Format))
+	}
+	packet := Packet{
+		Format:      frame.Format,
+		Measurement: packetMeasurement,
+		Fields:      make(map[string]interface{}, format.fields),
+		Tags:        make(map[string]string, format.tags+1),
+	}
+	if whitelist(formatTag) {
+		packet.Tags[formatTag] = frame.Format
+	}
+	frame.values = frame.appendValues(frame.values[:0], format.dash)
+	for i, element := range format.elements {
+		packet.addElement(element, frame.values[i], whitelist)
+	}
+	return packet
+}
+
+// appendValues appends the values of the sled elements, and the dash elements
+// if `dash` is set, in the order they are sent.
+func (frame *TelemetryFrame) appendValues(values []interface{}, dash bool) []interface{} {
+	values = frame.sledValues(values)
+	if dash {
+		values = frame.dashValues(values)
+	}
+	return values
+}
+
+// parseBufWithFrame parses the packet like ParseBuf, but packets of the built
+// in formats are decoded into `frame` and converted with frame.Packet, which
+// skips ParseBuf's reads through the bytes.Buffer and allocates less. Reusing
+// `frame` for every packet keeps the garbage created for each packet down.
+func parseBufWithFrame(buf *bytes.Buffer, whitelist Whitelist, frame *TelemetryFrame) (Packet, error) {
+	format := lookupPacketFormat(buf.Len())
+	if format == nil || !format.builtIn {
+		return ParseBuf(buf, whitelist)
+	}
+	if _, ok := telemetryFrameFormats[format.name]; !ok {
+		return ParseBuf(buf, whitelist)
+	}
+	if err := DecodeTelemetryFrame(buf.Bytes(), frame); err != nil {
+		return ParseBuf(buf, whitelist)
+	}
+	packetsParsed.WithLabelValues(frame.Format).Inc()
+	return frame.Packet(whitelist), nil
+}
+
+// telemetryFrameFormat holds the elements of a built in packet format which
+// have a value, in the order TelemetryFrame lists their values.
+type telemetryFrameFormat struct {
+	elements []*packetElement
+	// dash is set for formats with dash data.
+	dash bool
+	// fields and tags are the number of fields and tags of a packet of the
+	// format, used to size its maps.
+	fields int
+	tags   int
+}
+
+// telemetryFrameFormats holds the telemetryFrameFormat of each built in packet
+// format, keyed by format name. The number of values a frame has, with or
+// without dash data, is matched against the format's elements, and formats
+// that match neither are left out, so that values are never given to the
+// wrong elements.
+var telemetryFrameFormats = func() map[string]telemetryFrameFormat {
+	formats := make(map[string]telemetryFrameFormat, len(builtInPacketDefinitions))
+	for name, elements := range builtInPacketDefinitions {
+		var format telemetryFrameFormat
+		for _, element := range elements {
+			if element.dataType == skipType {
+				continue
+			}
+			format.elements = append(format.elements, element)
+			count := 1 + len(element.derived)
+			switch element.elementType {
+			case field:
+				format.fields += count
+			case tag:
+				format.tags += count
+			}
+		}
+		var frame TelemetryFrame
+		switch len(format.elements) {
+		case len(frame.appendValues(nil, false)):
+		case len(frame.appendValues(nil, true)):
+			format.dash = true
+		default:
+			continue
+		}
+		formats[name] = format
+	}
+	return formats
+}()
+
+// sledValues appends the values of the sled elements, in the order they are
+// sent.
+func (frame *TelemetryFrame) sledValues(values []interface{}) []interface{} {
+	return append(values,
+		frame.IsRaceOn,
+		frame.TimestampMs,
+		frame.EngineMaxRPM,
+		frame.EngineIdleRPM,
+		frame.CurrentEngineRPM,
+		frame.AccelerationX,
+		frame.AccelerationY,
+		frame.AccelerationZ,
+		frame.VelocityX,
+		frame.VelocityY,
+		frame.VelocityZ,
+		frame.AngularVelocityX,
+		frame.AngularVelocityY,
+		frame.AngularVelocityZ,
+		frame.Yaw,
+		frame.Pitch,
+		frame.Roll,
+		frame.NormalizedSuspensionTravelFrontLeft,
+		frame.NormalizedSuspensionTravelFrontRight,
+		frame.NormalizedSuspensionTravelRearLeft,
+		frame.NormalizedSuspensionTravelRearRight,
+		frame.TireSlipRatioFrontLeft,
+		frame.TireSlipRatioFrontRight,
+		frame.TireSlipRatioRearLeft,
+		frame.TireSlipRatioRearRight,
+		frame.WheelRotationSpeedFrontLeft,
+		frame.WheelRotationSpeedFrontRight,
+		frame.WheelRotationSpeedRearLeft,
+		frame.WheelRotationSpeedRearRight,
+		frame.OnRumbleStripFrontLeft,
+		frame.OnRumbleStripFrontRight,
+		frame.OnRumbleStripRearLeft,
+		frame.OnRumbleStripRearRight,
+		frame.PuddleDepthFrontLeft,
+		frame.PuddleDepthFrontRight,
+		frame.PuddleDepthRearLeft,
+		frame.PuddleDepthRearRight,
+		frame.SurfaceRumbleFrontLeft,
+		frame.SurfaceRumbleFrontRight,
+		frame.SurfaceRumbleRearLeft,
+		frame.SurfaceRumbleRearRight,
+		frame.TireSlipAngleFrontLeft,
+		frame.TireSlipAngleFrontRight,
+		frame.TireSlipAngleRearLeft,
+		frame.TireSlipAngleRearRight,
+		frame.TireCombinedSlipFrontLeft,
+		frame.TireCombinedSlipFrontRight,
+		frame.TireCombinedSlipRearLeft,
+		frame.TireCombinedSlipRearRight,
+		frame.SuspensionTravelMetersFrontLeft,
+		frame.SuspensionTravelMetersFrontRight,
+		frame.SuspensionTravelMetersRearLeft,
+		frame.SuspensionTravelMetersRearRight,
+		frame.CarID,
+		frame.CarClass,
+		frame.CarPerformanceIndex,
+		frame.DriveTrainType,
+		frame.NumEngineCylinders,
+	)
+}
+
+// dashValues appends the values of the dash elements, in the order they are
+// sent.
+func (frame *TelemetryFrame) dashValues(values []interface{}) []interface{} {
+	return append(values,
+		frame.PositionX,
+		frame.PositionY,
+		frame.PositionZ,
+		frame.Speed,
+		frame.Power,
+		frame.Torque,
+		frame.TireTempFrontRight,
+		frame.TireTempFrontLeft,
+		frame.TireTempRearLeft,
+		frame.TireTempRearRight,
+		frame.Boost,
+		frame.Fuel,
+		frame.DistanceTraveled,
+		frame.BestLapTime,
+		frame.LastLapTime,
+		frame.CurrentLapTime,
+		frame.CurrentRaceTime,
+		frame.LapNumber,
+		frame.RacePosition,
+		frame.Accel,
+		frame.Brake,
+		frame.Clutch,
+		frame.HandBrake,
+		frame.Gear,
+		frame.Steer,
+		frame.NormalizedDrivingLine,
+		frame.NormalizedAIBrakeDifference,
+	)
+}
+
+// frameReader reads little endian values from consecutive offsets of a packet.
+// The caller is responsible for checking that data is large enough.
+type frameReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *frameReader) next(n int) []byte {
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
+
+func (r *frameReader) s8() int8    { return int8(r.next(1)[0]) }
+func (r *frameReader) u8() uint8   { return r.next(1)[0] }
+func (r *frameReader) u16() uint16 { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *frameReader) s32() int32  { return int32(binary.LittleEndian.Uint32(r.next(4))) }
+func (r *frameReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *frameReader) f32() float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(r.next(4)))
+}